@@ -19,20 +19,21 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package apk
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/amaanq/sc-compression"
 	"github.com/hashicorp/go-retryablehttp"
-	"github.com/withmandala/go-log"
 	"golang.org/x/net/html"
 )
 
@@ -49,134 +50,426 @@ func (wg *WgetReader) Read(p []byte) (n int, err error) {
 }
 
 var (
-	CurrentVersion string
-	Path           = flag.String("path", ".", "output directory for /assets")
-	Client         = LoadRetryClient()
-	Log            = log.New(os.Stdout).WithColor().WithDebug().WithTimestamp()
+	// Deprecated: pass a client to New with WithHTTPClient instead, this is the one Default uses
+	Client = LoadRetryClient()
+	// Deprecated: pass a logger to New with WithLogger instead, this is the one Default uses
+	Log = NewLogger()
 )
 
 func LoadRetryClient() *retryablehttp.Client {
-	Client := retryablehttp.NewClient()
-	Client.Logger = nil
-	Client.RetryMax = 5
+	Client, _ := NewHTTPClient(HTTPConfig{Retries: DefaultHTTPRetries}) // can't fail without a proxy
 	return Client
 }
 
-func UpdateAPK() error {
-	version, err := GetCurrentAPKVersion(true)
+// Checks game for a new version and downloads, decompiles and decompresses it
+func UpdateAPK(game *GameLink) error {
+	_, err := Default.UpdateAPK(context.Background(), game)
+	return err
+}
+
+// Checks game for a new version and downloads, decompiles and decompresses it into the output root.
+// The returned release is nil if the updater already brought game up to date
+func (u *Updater) UpdateAPK(ctx context.Context, game *GameLink) (*Release, error) {
+	version, err := u.GetCurrentAPKVersion(ctx, game, true)
 	if err != nil {
-		Log.Error(err)
-		return err
+		u.log.Error("Checking the current version failed", "game", game.Name, "err", err)
+		return nil, err
 	}
 
-	if version == CurrentVersion {
-		Log.Info("You are up to date!")
-		return nil
+	if version.String() == u.CurrentVersion(game) {
+		u.log.Info("Up to date", "game", game.Name, "version", version)
+		return nil, nil
 	}
-	CurrentVersion = version
 
-	Log.Info("New game version available! (" + version + ")")
-	url, err := GetDownloadURL(ClashofClans.URL)
+	u.log.Info("New version available", "game", game.Name, "version", version)
+	data, err := u.findVersion(ctx, game, version)
 	if err != nil {
-		Log.Error(err)
-		return err
+		u.log.Error("Finding the version failed", "game", game.Name, "version", version, "err", err)
+		return nil, err
 	}
 
-	if _, err = WgetAPK(&ClashofClans, url, version, ""); err != nil {
-		Log.Error(err)
-		return err
+	release, err := u.Fetch(ctx, game, *data)
+	if err != nil {
+		u.log.Error("Fetching failed", "game", game.Name, "version", version, "err", err)
+		return nil, err
+	}
+
+	u.mu.Lock()
+	u.currentVersions[game.Name] = version.String()
+	u.mu.Unlock()
+	u.log.Info("Done", "game", game.Name, "version", version)
+
+	return release, nil
+}
+
+// Finds version on the first versions page, falling back to the download button of the game's page
+// when the listing lags behind
+func (u *Updater) findVersion(ctx context.Context, game *GameLink, version Version) (*VersionData, error) {
+	versions, err := u.GetVersions(ctx, u.source.VersionsURL(game), 1)
+	if err != nil && !errors.Is(err, ErrLastPage) {
+		return nil, err
+	}
+	for i := range versions {
+		if versions[i].Version.Compare(version) == 0 {
+			return &versions[i], nil
+		}
 	}
+	return &VersionData{Version: version, URL: u.source.AppURL(game)}, nil
+}
 
-	Log.Info("Removing Potential Base Path Collision")
-	os.RemoveAll("clash-" + version)
+// Where each step of Fetch left its output
+type Release struct {
+	Game           *GameLink
+	Version        VersionData
+	APKPath        string
+	DecompiledPath string
+	AssetsPath     string
+	Manifest       *Manifest // set when the updater has a store
+	Assets         AssetCounts
+
+	assetsDir string // where AssetsPath goes once decompressed
+}
 
-	if err = DecompileAPK("clash-" + version + ".apk"); err != nil {
-		Log.Error(err)
+// Returns the newest version of game, only the first versions page is fetched
+func (u *Updater) Latest(ctx context.Context, game *GameLink) (*VersionData, error) {
+	versions, err := u.GetVersions(ctx, u.source.VersionsURL(game), 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no versions listed for %s", game.Name)
+	}
+	SortVersions(versions)
+	return &versions[0], nil
+}
+
+// Changes where Fetch puts its output
+type FetchOption func(*Release)
+
+// Decompresses the assets into dir instead of AssetsPath
+func WithAssetsDir(dir string) FetchOption {
+	return func(r *Release) {
+		r.assetsDir = dir
+	}
+}
+
+// Downloads, decompiles and decompresses a version of game into the output root as
+// slug-version.apk, slug-version/ and slug-version-decompressed/
+func (u *Updater) Fetch(ctx context.Context, game *GameLink, version VersionData, opts ...FetchOption) (*Release, error) {
+	base := u.basePath(game, version.Version.String())
+	release := &Release{Game: game, Version: version, DecompiledPath: base, assetsDir: u.AssetsPath(game, version.Version.String())}
+	for _, opt := range opts {
+		opt(release)
+	}
+	return u.run(ctx, release, u.fetch)
+}
+
+// Decompiles an APK on disk next to itself and decompresses its assets into assetsDir, running the same hooks as Fetch.
+// Without a version nothing is added to the store
+func (u *Updater) DecompressAPK(ctx context.Context, game *GameLink, apkPath, assetsDir string) (*Release, error) {
+	release := &Release{Game: game, APKPath: apkPath, DecompiledPath: strings.TrimSuffix(apkPath, ".apk"), assetsDir: assetsDir}
+	return u.run(ctx, release, u.decompile)
+}
+
+// Decompresses the assets of an already decompiled APK into assetsDir, running the on_decompress and on_error hooks
+func (u *Updater) DecompressDecompiled(ctx context.Context, game *GameLink, decompiledPath, assetsDir string) (*Release, error) {
+	release := &Release{Game: game, DecompiledPath: decompiledPath, assetsDir: assetsDir}
+	return u.run(ctx, release, u.decompress)
+}
+
+// Runs the pipeline from step on, emitting the summary and running the on_error hooks when it fails
+func (u *Updater) run(ctx context.Context, release *Release, step func(context.Context, *Release) error) (*Release, error) {
+	if release.assetsDir == release.DecompiledPath { // the assets would be decompressed over the APK's own
+		release.assetsDir = filepath.Join(release.assetsDir, "decompressed")
+	}
+
+	start := time.Now()
+	err := step(ctx, release)
+	u.Emit(SummaryEvent(release.Game, release.Version.Version, start, release.summary(), err))
+	if err != nil {
+		if ctx.Err() == nil {
+			_ = u.RunHooks(ctx, OnError, release.hookContext(err))
+		}
+		return nil, err
+	}
+	return release, nil
+}
+
+func (u *Updater) fetch(ctx context.Context, release *Release) error {
+	game, version := release.Game, release.Version
+	url, err := u.Resolve(ctx, &version)
+	if err != nil {
 		return err
 	}
+	u.Emit(ResolvedEvent(game, version, url))
 
-	Log.Info("Removing Potential Assets Path Collision")
-	os.RemoveAll(*Path + "/assets" + CurrentVersion)
+	u.log.Info("Downloading APK", "game", game.Name, "version", version.Version, "date", version.Date)
+	if release.APKPath, err = u.WgetAPK(ctx, game, url, version.Version.String(), release.DecompiledPath+".apk"); err != nil {
+		return err
+	}
+	if err = u.VerifySigner(ctx, game, release.APKPath); err != nil {
+		return err
+	}
+	_ = u.RunHooks(ctx, OnDownload, release.hookContext(nil))
 
-	Log.Info("Decompressing assets...")
-	if _, err = WalkAndDecompressAssets(ClashofClans.ValidDirectories, "clash-"+version, "decompressed"+version); err != nil {
-		Log.Error(err)
+	os.RemoveAll(release.DecompiledPath) // Potential base path collision
+	if err = u.decompile(ctx, release); err != nil {
 		return err
 	}
 
-	Log.Info("Done!")
+	if u.store != nil {
+		if release.Manifest, err = u.store.Put(game, version, release.AssetsPath); err != nil {
+			return fmt.Errorf("storing assets: %w", err)
+		}
+		u.log.Info("Stored assets", "game", game.Name, "version", version.Version, "files", len(release.Manifest.Files), "store", u.store.Dir)
+	}
+	return nil
+}
 
+func (u *Updater) decompile(ctx context.Context, release *Release) error {
+	if err := u.DecompileAPK(ctx, release.APKPath); err != nil {
+		return err
+	}
+	if err := VerifyPackage(release.Game, release.DecompiledPath); err != nil {
+		return err
+	}
+	_ = u.RunHooks(ctx, OnDecompile, release.hookContext(nil))
+	return u.decompress(ctx, release)
+}
+
+func (u *Updater) decompress(ctx context.Context, release *Release) (err error) {
+	u.log.Info("Decompressing assets", "game", release.Game.Name, "version", release.Version.Version, "path", release.DecompiledPath)
+	if release.Assets, err = u.DecompressAssets(ctx, release.Game.ValidDirectories, release.DecompiledPath, release.assetsDir); err != nil {
+		return err
+	}
+	release.AssetsPath = release.assetsDir
+	_ = u.RunHooks(ctx, OnDecompress, release.hookContext(nil))
 	return nil
 }
 
+func (r *Release) summary() Summary {
+	return Summary{
+		APKPath:        r.APKPath,
+		DecompiledPath: r.DecompiledPath,
+		AssetsPath:     r.AssetsPath,
+		Decompressed:   r.Assets.Decompressed,
+		Failed:         r.Assets.Failed,
+	}
+}
+
+func (r *Release) hookContext(err error) HookContext {
+	return HookContext{
+		Game:           r.Game.Name,
+		Version:        r.Version.Version.String(),
+		APKPath:        r.APKPath,
+		DecompiledPath: r.DecompiledPath,
+		AssetsPath:     r.AssetsPath,
+		Err:            err,
+	}
+}
+
+// Runs the updater's hook commands for event, failures are logged and returned but never stop the pipeline
+func (u *Updater) RunHooks(ctx context.Context, event HookEvent, hc HookContext) error {
+	return u.hooks.Run(ctx, u.log, event, hc)
+}
+
+func (u *Updater) basePath(game *GameLink, version string) string {
+	return filepath.Join(u.outputRoot, game.Slug()+"-"+version)
+}
+
+// Where Fetch puts the decompressed assets of a version
+func (u *Updater) AssetsPath(game *GameLink, version string) string {
+	return u.basePath(game, version) + "-decompressed"
+}
+
 // Walk the assets folder and decompress each file inside
 func WalkAndDecompressAssets(validDirs []string, fpToDecompiledAPK, fpToOutputFiles string) (string, error) {
+	return WalkAndDecompressAssetsContext(context.Background(), validDirs, fpToDecompiledAPK, fpToOutputFiles)
+}
+
+// Like WalkAndDecompressAssets but stops between files once ctx is done, removing the partial output folder
+func WalkAndDecompressAssetsContext(ctx context.Context, validDirs []string, fpToDecompiledAPK, fpToOutputFiles string) (string, error) {
+	return Default.WalkAndDecompressAssets(ctx, validDirs, fpToDecompiledAPK, fpToOutputFiles)
+}
+
+// Walks the assets folder and decompresses each file inside, stopping between files once ctx is done
+func (u *Updater) WalkAndDecompressAssets(ctx context.Context, validDirs []string, fpToDecompiledAPK, fpToOutputFiles string) (string, error) {
+	if _, err := u.DecompressAssets(ctx, validDirs, fpToDecompiledAPK, fpToOutputFiles); err != nil {
+		return "", err
+	}
+	return fpToOutputFiles, nil
+}
+
+// How many assets were decompressed and how many were skipped as corrupt
+type AssetCounts struct {
+	Decompressed int
+	Failed       int
+}
+
+// Like WalkAndDecompressAssets but also returns how many files were decompressed and how many failed
+func (u *Updater) DecompressAssets(ctx context.Context, validDirs []string, fpToDecompiledAPK, fpToOutputFiles string) (AssetCounts, error) {
 	os.RemoveAll(fpToOutputFiles)
 	err := os.Mkdir(fpToOutputFiles, 0755)
 	if err != nil && !os.IsExist(err) {
-		Log.Error(fpToOutputFiles)
-		Log.Error(err)
-		return "", err
+		u.log.Error("Creating the output folder failed", "path", fpToOutputFiles, "err", err)
+		return AssetCounts{}, err
 	}
 
+	counts, err := u.walkAndDecompressAssets(ctx, validDirs, fpToDecompiledAPK, fpToOutputFiles)
+	if err != nil && ctx.Err() != nil {
+		os.RemoveAll(fpToOutputFiles)
+	}
+	return counts, err
+}
+
+func (u *Updater) walkAndDecompressAssets(ctx context.Context, validDirs []string, fpToDecompiledAPK, fpToOutputFiles string) (counts AssetCounts, err error) {
+	// Listed up front so the progress knows how many files there are
+	var files []string
 	for _, subdir := range validDirs {
-		entries, err := os.ReadDir("./" + fpToDecompiledAPK + "/assets/" + subdir + "/")
+		entries, err := os.ReadDir(filepath.Join(fpToDecompiledAPK, "assets", subdir))
 		if err != nil {
 			continue
 		}
 
-		err = os.Mkdir(fpToOutputFiles+"/"+subdir, 0755)
+		err = os.Mkdir(filepath.Join(fpToOutputFiles, subdir), 0755)
 		if err != nil && !os.IsExist(err) {
-			Log.Error(err)
-			return "", err
+			u.log.Error("Creating the output folder failed", "path", filepath.Join(fpToOutputFiles, subdir), "err", err)
+			return counts, err
 		}
 
 		for _, entry := range entries {
-			if entry.IsDir() {
-				continue
-			}
-			fileName := entry.Name()
-			fullPath := "./" + fpToDecompiledAPK + "/assets/" + subdir + "/" + fileName
-			t := time.Now()
-			year, month, day := t.Date()
-			hour, min, sec := t.Clock()
-			date := fmt.Sprintf("%d/%02d/%02d %02d:%02d:%02d", year, month, day, hour, min, sec)
-			fmt.Printf("\033[2K\r\033[0;32m[INFO] \033[0;34m %s \033[0mDecompressing %s", date, fullPath)
-			compFile, err := os.Open(fullPath)
-			if err != nil {
-				return "", err
-			}
-			decompressor := ScCompression.NewDecompressor(compFile)
-			reader, err := decompressor.Decompress()
-			if err != nil {
-				Log.Errorf("Failed to decompress %s: %s\n", fullPath, err)
-				continue
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(subdir, entry.Name()))
 			}
+		}
+	}
 
-			fd, err := os.Create(fpToOutputFiles + "/" + subdir + "/" + fileName)
-			if err != nil {
-				return "", err
-			}
-			if _, err = io.Copy(fd, reader); err != nil {
-				return "", err
-			}
-			if err = fd.Close(); err != nil {
-				return "", err
+	task := u.progress.Start("Decompressing "+filepath.Base(fpToDecompiledAPK), Items, int64(len(files)))
+	defer func() { task.Finish(err) }()
+	for _, file := range files {
+		if err = ctx.Err(); err != nil {
+			return counts, err
+		}
+		fullPath := filepath.Join(fpToDecompiledAPK, "assets", file)
+		event := Event{Event: EventAsset, File: filepath.ToSlash(file), Status: AssetDecompressed}
+		var format string
+		if format, err = decompressFile(fullPath, filepath.Join(fpToOutputFiles, file)); err != nil {
+			if !errors.Is(err, errCorrupt) && !errors.Is(err, errUnsupported) {
+				return counts, err
 			}
+			u.log.Error("Failed to decompress", "file", fullPath, "err", err)
+			event.Status, event.Error = AssetFailed, err.Error()
+			counts.Failed++
+			err = nil
+		} else {
+			counts.Decompressed++
 		}
+		u.metrics.AssetDone(format, event.Status)
+		u.Emit(event)
+		task.Advance(1, event.File)
 	}
-	fmt.Printf("\n")
-	return fpToOutputFiles, nil
+	return counts, nil
+}
+
+var (
+	errCorrupt     = errors.New("corrupt asset")
+	errUnsupported = errors.New("unsupported compression")
+)
+
+// Decompresses a single asset and returns its compression format, the output file is removed if anything goes wrong.
+// Uncompressed assets are copied as is
+func decompressFile(src, dst string) (string, error) {
+	compFile, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer compFile.Close()
+
+	header := make([]byte, 31)
+	n, err := io.ReadFull(compFile, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	format := assetFormat(header[:n])
+	if _, err = compFile.Seek(0, io.SeekStart); err != nil {
+		return format, err
+	}
+
+	var reader io.Reader = compFile
+	switch format {
+	case "none":
+		// sc-compression drops the header it sniffed from plain files and panics on empty ones
+	case "sclz", "zstd":
+		return format, fmt.Errorf("%w: %s", errUnsupported, format)
+	default:
+		decompressed, err := scDecompress(compFile)
+		if err != nil {
+			return format, err
+		}
+		reader = corruptReader{decompressed}
+	}
+
+	fd, err := os.Create(dst)
+	if err != nil {
+		return format, err
+	}
+	if _, err = io.Copy(fd, reader); err != nil {
+		fd.Close()
+		os.Remove(dst)
+		return format, err
+	}
+	if err = fd.Close(); err != nil {
+		os.Remove(dst)
+		return format, err
+	}
+	return format, nil
+}
+
+// sc-compression panics on some malformed inputs, e.g. seeking before the start of a file too short for its header.
+// Those come back as errCorrupt so one bad asset can't take down a long running watch or job worker
+func scDecompress(f *os.File) (r io.Reader, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			r, err = nil, fmt.Errorf("%w: %v", errCorrupt, p)
+		}
+	}()
+	r, err = ScCompression.NewDecompressor(f).Decompress()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errCorrupt, err)
+	}
+	return r, nil
 }
 
-// Parses the uptodown HTML node for the current game version
-func GetCurrentAPKVersion(_print bool) (string, error) {
+// Marks errors reading decompressed data as errCorrupt, they come from a broken stream rather than the disk
+type corruptReader struct {
+	r io.Reader
+}
+
+func (c corruptReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %s", errCorrupt, err)
+	}
+	return n, err
+}
+
+// Parses the uptodown page of game for its current version
+func GetCurrentAPKVersion(game *GameLink, _print bool) (string, error) {
+	version, err := Default.GetCurrentAPKVersion(context.Background(), game, _print)
+	if err != nil {
+		return "", err
+	}
+	return version.String(), nil
+}
+
+// Parses the game's page on the updater's source for its current version
+func (u *Updater) GetCurrentAPKVersion(ctx context.Context, game *GameLink, _print bool) (Version, error) {
 	if _print {
-		Log.Info("Checking version...")
+		u.log.Info("Checking version", "game", game.Name)
 	}
-	node, err := CurlAPKLink(ClashofClans.URL)
+	node, err := u.CurlAPKLink(ctx, u.source.AppURL(game))
 	if err != nil {
-		Log.Error(err)
+		return Version{}, err
 	}
 
 	query := goquery.NewDocumentFromNode(node)
@@ -186,22 +479,33 @@ func GetCurrentAPKVersion(_print bool) (string, error) {
 			var metadata MetaData
 			err := json.Unmarshal([]byte(script.Text()), &metadata)
 			if err != nil {
-				Log.Error(err)
+				u.log.Error("Parsing the app metadata failed", "game", game.Name, "err", err)
 			}
 			version = metadata.MainEntity.SoftwareVersion
 		}
 	})
 	if version == "" {
-		return version, errors.New("couldn't find the version")
+		return Version{}, fmt.Errorf("couldn't find the %s version", game.Name)
 	}
-	return version, nil
+	return ParseVersion(version)
 }
 
 // Parses the uptodown HTML node for the download link
 func GetDownloadURL(url string) (string, error) {
-	node, err := CurlAPKLink(url)
+	return GetDownloadURLContext(context.Background(), url)
+}
+
+// Like GetDownloadURL but the request is cancelled with ctx
+func GetDownloadURLContext(ctx context.Context, url string) (string, error) {
+	return Default.GetDownloadURL(ctx, url)
+}
+
+// Parses the uptodown page of a version for its download link.
+// The page is never cached, its download token expires long before a cached page would
+func (u *Updater) GetDownloadURL(ctx context.Context, url string) (string, error) {
+	node, err := u.curlPage(ctx, url, false)
 	if err != nil {
-		Log.Error(err)
+		return "", err
 	}
 
 	query := goquery.NewDocumentFromNode(node)
@@ -213,24 +517,73 @@ func GetDownloadURL(url string) (string, error) {
 		}
 	})
 	if downloadUrl == "" {
-		return downloadUrl, errors.New("couldn't find the version")
+		return downloadUrl, errors.New("couldn't find the download link")
 	}
 	return downloadUrl, nil
 }
 
-// Executes apktool and removes the apk file
+// Executes apktool, the decompiled APK ends up next to it without the .apk extension
 func DecompileAPK(apkPath string) error {
-	Log.Info("Decompiling APK!")
-	err := exec.Command("apktool", "d", apkPath, "-f").Run()
-	if err != nil {
+	return DecompileAPKContext(context.Background(), apkPath)
+}
+
+// Like DecompileAPK but kills apktool and removes its half written output once ctx is done
+func DecompileAPKContext(ctx context.Context, apkPath string) error {
+	return Default.DecompileAPK(ctx, apkPath)
+}
+
+// Executes apktool, killing it and removing its half written output once ctx is done
+func (u *Updater) DecompileAPK(ctx context.Context, apkPath string) (err error) {
+	u.log.Info("Decompiling APK", "file", apkPath)
+	outDir := strings.TrimSuffix(apkPath, ".apk")
+	u.Emit(Event{Event: EventDecompileStart, Path: apkPath})
+	defer func() { u.Emit(Event{Event: EventDecompileDone, Path: outDir, Error: errorString(err)}) }()
+
+	cmd := exec.Command("apktool", "d", apkPath, "-f", "-o", outDir)
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
 		return err
 	}
-	return err
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		os.RemoveAll(outDir)
+		return ctx.Err()
+	}
 }
 
 // Get uptodowns HTML page
 func CurlAPKLink(link string) (*html.Node, error) {
-	resp, err := Client.Get(link)
+	return CurlAPKLinkContext(context.Background(), link)
+}
+
+// Like CurlAPKLink but the request is cancelled with ctx
+func CurlAPKLinkContext(ctx context.Context, link string) (*html.Node, error) {
+	return Default.CurlAPKLink(ctx, link)
+}
+
+// Gets an uptodown HTML page
+func (u *Updater) CurlAPKLink(ctx context.Context, link string) (*html.Node, error) {
+	return u.curlPage(ctx, link, true)
+}
+
+// Gets an HTML page, one that isn't cacheable always comes from the mirror, see CacheTransport
+func (u *Updater) curlPage(ctx context.Context, link string, cacheable bool) (*html.Node, error) {
+	req, err := retryablehttp.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !cacheable {
+		req.Header.Set("Cache-Control", "no-store")
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -245,6 +598,21 @@ func CurlAPKLink(link string) (*html.Node, error) {
 
 // Download the APK from uptodown with a progress bar
 func WgetAPK(game *GameLink, downloadUrl, version, fp string) (string, error) {
+	return WgetAPKContext(context.Background(), game, downloadUrl, version, fp)
+}
+
+// Like WgetAPK but aborts the download once ctx is done, a partially written APK is always removed
+func WgetAPKContext(ctx context.Context, game *GameLink, downloadUrl, version, fp string) (string, error) {
+	return Default.WgetAPK(ctx, game, downloadUrl, version, fp)
+}
+
+// Downloads an APK with a progress bar, a partially written APK is always removed.
+// Without fp the APK is stored in the output root as name-version.apk
+func (u *Updater) WgetAPK(ctx context.Context, game *GameLink, downloadUrl, version, fp string) (_ string, err error) {
+	var received int64
+	start := time.Now()
+	defer func() { u.metrics.DownloadDone(game.Name, received, time.Since(start), err) }()
+
 	req, err := retryablehttp.NewRequest("GET", downloadUrl, nil)
 	if err != nil {
 		return "", err
@@ -258,14 +626,18 @@ func WgetAPK(game *GameLink, downloadUrl, version, fp string) (string, error) {
 	req.Header.Set("Host", "dw89.uptodown.com")
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:98.0) Gecko/20100101 Firefox/98.0")
 
-	resp, err := Client.Do(req)
+	resp, err := u.client.Do(req.WithContext(ctx))
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading %s: %s", downloadUrl, resp.Status)
+	}
+
 	if fp == "" {
-		fp = strings.ToLower(strings.ReplaceAll(game.Name, " ", "")) + "-" + version + ".apk" // clashofclans-14.426.4.apk
+		fp = filepath.Join(u.outputRoot, game.Slug()+"-"+version+".apk") // clashofclans-14.426.4.apk
 	}
 
 	__fd, err := os.Create(fp)
@@ -273,44 +645,20 @@ func WgetAPK(game *GameLink, downloadUrl, version, fp string) (string, error) {
 		return "", err
 	}
 
-	total := int64(0)
-	speed := 0.0
-	start := time.Now()
+	task := u.progress.Start("Downloading "+filepath.Base(fp), Bytes, resp.ContentLength)
 	pr := &WgetReader{resp.Body, resp.ContentLength, func(r int64) {
-		total += r
-		percent := float64(total) / float64(resp.ContentLength) * 100
-		t := time.Now()
-		year, month, day := t.Date()
-		hour, min, sec := t.Clock()
-		date := fmt.Sprintf("%d/%02d/%02d %02d:%02d:%02d", year, month, day, hour, min, sec)
-		speed = float64(total) / float64(time.Since(start).Milliseconds()) / 125 / 8
-		if r > 0 && percent != 100.00 {
-			fmt.Printf("\033[2K\r\033[0;32m[INFO] \033[0;34m %s \033[0m%.2f%% %.2f mb/s", date, percent, speed)
-		} else {
-			fmt.Printf("\033[2K\r\033[0;32m[INFO] \033[0;34m %s \033[0m100%% %.2f mb/s took %.2f seconds", date, speed, time.Since(start).Seconds())
-		}
+		received += r
+		task.Advance(r, "")
 	}}
 
-	_, _ = io.Copy(__fd, pr)
-	fmt.Printf("\n")
-	__fd.Close()
-	return fp, err
-}
-
-func CleanUp(assetsFP, apkFP string) error {
-	outerFP := strings.Split(assetsFP, "/")
-	outFP := outerFP[len(outerFP)-1]
-	err := os.Rename(assetsFP, "./"+outFP)
-	if err != nil {
-		return err
+	_, err = io.Copy(__fd, pr)
+	if closeErr := __fd.Close(); err == nil {
+		err = closeErr
 	}
-	err = os.RemoveAll(outerFP[0])
+	task.Finish(err)
 	if err != nil {
-		return err
-	}
-	err = os.RemoveAll(apkFP)
-	if err != nil {
-		return err
+		os.Remove(fp)
+		return "", err
 	}
-	return nil
+	return fp, nil
 }
@@ -0,0 +1,216 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A git repository holding the decompressed assets of every archived version, one commit and tag per version.
+// Each game lives in its own folder named after its slug so several games can share a repository
+type GitArchive struct {
+	Dir string
+}
+
+// Opens the repository at dir, creating and initializing it if needed
+func OpenGitArchive(ctx context.Context, dir string) (*GitArchive, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git is required to archive versions: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	a := &GitArchive{Dir: dir}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); errors.Is(err, fs.ErrNotExist) {
+		if _, err = a.git(ctx, "init", "-q"); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *GitArchive) git(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = a.Dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Reports whether the repository has no commits yet
+func (a *GitArchive) Empty(ctx context.Context) bool {
+	_, err := a.git(ctx, "rev-parse", "--verify", "-q", "HEAD")
+	return err != nil
+}
+
+// The tag a version is archived under, e.g. clashofclans-15.83.24
+func (a *GitArchive) Tag(game *GameLink, version Version) string {
+	return game.Slug() + "-" + version.String()
+}
+
+// Reports whether a version of game was already archived
+func (a *GitArchive) Has(ctx context.Context, game *GameLink, version Version) bool {
+	_, err := a.git(ctx, "rev-parse", "--verify", "-q", "refs/tags/"+a.Tag(game, version))
+	return err == nil
+}
+
+// Replaces game's folder in the worktree with assetsDir, commits it and tags the commit.
+// A version whose assets didn't change still gets an (empty) commit so every version has a tag
+func (a *GitArchive) Commit(ctx context.Context, game *GameLink, version VersionData, assetsDir string) error {
+	worktree := filepath.Join(a.Dir, game.Slug())
+	if err := os.RemoveAll(worktree); err != nil {
+		return err
+	}
+	if err := copyTree(assetsDir, worktree); err != nil {
+		return err
+	}
+	if _, err := a.git(ctx, "add", "-A", "--", game.Slug()); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("%s %s", game.Name, version.Version)
+	if version.Date != "" {
+		message += fmt.Sprintf("\n\nReleased on %s", version.Date)
+	}
+	args := []string{"commit", "-q", "--allow-empty", "-m", message}
+	if _, err := a.git(ctx, "config", "user.email"); err != nil {
+		// Commits would fail without an identity, fall back to one for the tool itself
+		args = append([]string{"-c", "user.name=apk-updater", "-c", "user.email=apk-updater@localhost"}, args...)
+	}
+	if _, err := a.git(ctx, args...); err != nil {
+		return err
+	}
+	_, err := a.git(ctx, "tag", "-f", a.Tag(game, version.Version))
+	return err
+}
+
+// Copies the regular files under src to dst, keeping the folder layout
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Fetches each version of game that isn't archived yet and commits it, in the order given.
+// Unless keep is set the APK, decompiled and decompressed folders are removed once a version is committed
+func (u *Updater) Archive(ctx context.Context, archive *GitArchive, game *GameLink, versions []VersionData, keep bool) error {
+	for _, version := range versions {
+		if archive.Has(ctx, game, version.Version) {
+			u.log.Info("Already archived, skipping", "game", game.Name, "version", version.Version)
+			continue
+		}
+
+		release, err := u.Fetch(ctx, game, version)
+		if err != nil {
+			return fmt.Errorf("fetching %s %s: %w", game.Name, version.Version, err)
+		}
+		if err = archive.Commit(ctx, game, version, release.AssetsPath); err != nil {
+			return fmt.Errorf("archiving %s %s: %w", game.Name, version.Version, err)
+		}
+		u.log.Info("Archived", "game", game.Name, "version", version.Version, "tag", archive.Tag(game, version.Version))
+
+		if !keep {
+			release.Remove()
+		}
+	}
+	return nil
+}
+
+// Deletes everything Fetch wrote for this release
+func (r *Release) Remove() {
+	os.Remove(r.APKPath)
+	os.RemoveAll(r.DecompiledPath)
+	os.RemoveAll(r.AssetsPath)
+}
+
+// Deletes the APK and the decompiled folder, keeping only the decompressed assets.
+// Assets decompressed into the decompiled folder itself are kept along with it
+func (r *Release) RemoveIntermediates() error {
+	if r.APKPath != "" {
+		if err := os.Remove(r.APKPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if r.DecompiledPath == "" {
+		return nil
+	}
+	rel, err := filepath.Rel(r.DecompiledPath, r.AssetsPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return os.RemoveAll(r.DecompiledPath)
+	}
+	if rel == "." {
+		return nil
+	}
+	keep := strings.Split(rel, string(filepath.Separator))[0]
+	entries, err := os.ReadDir(r.DecompiledPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() != keep {
+			if err := os.RemoveAll(filepath.Join(r.DecompiledPath, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fp := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGitArchive(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "history")
+	archive, err := OpenGitArchive(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !archive.Empty(ctx) {
+		t.Fatal("a new archive should be empty")
+	}
+
+	old, next := t.TempDir(), t.TempDir()
+	writeTree(t, old, map[string]string{"csv_logic/characters.csv": "Name\nBarbarian,1\n", "localization/texts.csv": "TID\n"})
+	writeTree(t, next, map[string]string{"csv_logic/characters.csv": "Name\nBarbarian,2\n", "logic/new.csv": "x\n"})
+
+	v1 := VersionData{Version: MustParseVersion("15.0.1"), Date: "Jan 1, 2023"}
+	v2 := VersionData{Version: MustParseVersion("15.1.0"), Date: "Feb 1, 2023"}
+	if err = archive.Commit(ctx, &BrawlStars, v1, old); err != nil {
+		t.Fatal(err)
+	}
+	if err = archive.Commit(ctx, &BrawlStars, v2, next); err != nil {
+		t.Fatal(err)
+	}
+
+	if archive.Empty(ctx) || !archive.Has(ctx, &BrawlStars, v1.Version) || !archive.Has(ctx, &BrawlStars, v2.Version) {
+		t.Fatal("both versions should be tagged")
+	}
+	if archive.Has(ctx, &BrawlStars, MustParseVersion("16.0")) {
+		t.Error("Has() found a version that was never archived")
+	}
+
+	subjects, err := archive.git(ctx, "log", "--format=%s|%b", "brawlstars-15.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(subjects, "Brawl Stars 15.1.0|Released on Feb 1, 2023") || !strings.Contains(subjects, "Brawl Stars 15.0.1|") {
+		t.Errorf("unexpected history:\n%s", subjects)
+	}
+
+	// The second commit replaces the tree, so removed files are gone
+	files, err := archive.git(ctx, "ls-tree", "-r", "--name-only", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != "brawlstars/csv_logic/characters.csv\nbrawlstars/logic/new.csv" {
+		t.Errorf("HEAD tree = %q", files)
+	}
+}
+
+func TestReleaseRemoveIntermediates(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "out")
+	sibling := filepath.Join(root, "other", "keep.txt")
+	writeTree(t, root, map[string]string{
+		"other/keep.txt":                      "unrelated",
+		"brawlstars-1.0.apk":                  "PK",
+		"brawlstars-1.0/AndroidManifest.xml":  "<manifest/>",
+		"brawlstars-1.0-decompressed/a/b.csv": "x",
+		"brawlstars-1.1/assets/a/b.csv":       "compressed",
+		"brawlstars-1.1/decompressed/a/b.csv": "x",
+		"brawlstars-1.1/apktool.yml":          "version: 2",
+	})
+
+	u := New(WithOutputRoot(root), WithProgress(NoProgress{}))
+	base := filepath.Join(root, "brawlstars-1.0")
+	release := &Release{Game: &BrawlStars, APKPath: base + ".apk", DecompiledPath: base, AssetsPath: u.AssetsPath(&BrawlStars, "1.0")}
+	if err := release.RemoveIntermediates(); err != nil {
+		t.Fatal(err)
+	}
+	for _, gone := range []string{release.APKPath, release.DecompiledPath} {
+		if _, err := os.Stat(gone); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s wasn't removed (stat error = %v)", gone, err)
+		}
+	}
+	for _, kept := range []string{filepath.Join(release.AssetsPath, "a", "b.csv"), sibling} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("%s should be kept: %v", kept, err)
+		}
+	}
+
+	// Assets decompressed into the decompiled folder survive, the rest of it goes
+	nested := &Release{Game: &BrawlStars, DecompiledPath: filepath.Join(root, "brawlstars-1.1"), AssetsPath: filepath.Join(root, "brawlstars-1.1", "decompressed")}
+	if err := nested.RemoveIntermediates(); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(nested.DecompiledPath)
+	if len(entries) != 1 || entries[0].Name() != "decompressed" {
+		t.Errorf("decompiled folder still holds %v, want only the assets", entries)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The versions a backfill already finished per game slug, kept on disk so an interrupted backfill picks up where it left off
+type BackfillState struct {
+	mu        sync.Mutex
+	path      string
+	Completed map[string][]string `json:"completed"`
+}
+
+// Loads the state file, a missing file is an empty state
+func LoadBackfillState(path string) (*BackfillState, error) {
+	state := &BackfillState{path: path, Completed: make(map[string][]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Completed == nil {
+		state.Completed = make(map[string][]string)
+	}
+	return state, nil
+}
+
+func (s *BackfillState) Done(game *GameLink, version Version) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.Completed[game.Slug()] {
+		if v == version.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Records the version and writes the state file right away
+func (s *BackfillState) MarkDone(game *GameLink, version Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Completed[game.Slug()] = append(s.Completed[game.Slug()], version.String())
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Where the backfill state lives unless told otherwise, e.g. ~/.config/apk-updater/backfill-state.json
+func DefaultBackfillStateFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "apk-updater", "backfill-state.json")
+}
+
+const (
+	// How many versions a backfill fetches at once unless told otherwise
+	DefaultBackfillConcurrency = 2
+	// Minimum time between two backfill downloads unless told otherwise
+	DefaultBackfillInterval = 5 * time.Second
+)
+
+// Fetches every given version of a game into the updater's store, skipping the ones a previous run completed
+type Backfill struct {
+	Updater     *Updater
+	Game        *GameLink
+	State       *BackfillState
+	Concurrency int           // versions fetched at once, at least 1
+	Interval    time.Duration // minimum time between two downloads starting
+	Keep        bool          // keep the APK and extracted folders once a version is stored, always kept without a store
+}
+
+// What a backfill did, versions are listed oldest first
+type BackfillReport struct {
+	Game      string            `json:"game"`
+	Succeeded []string          `json:"succeeded"`
+	Skipped   []string          `json:"skipped"`
+	Failed    map[string]string `json:"failed"` // version -> error
+	Duration  time.Duration     `json:"duration"`
+}
+
+func (r *BackfillReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Backfilled %s in %s: %d succeeded, %d skipped, %d failed", r.Game, r.Duration.Round(time.Second), len(r.Succeeded), len(r.Skipped), len(r.Failed))
+	failed := make([]string, 0, len(r.Failed))
+	for v := range r.Failed {
+		failed = append(failed, v)
+	}
+	sortVersionStrings(failed)
+	for _, v := range failed {
+		fmt.Fprintf(&b, "\n  %s: %s", v, r.Failed[v])
+	}
+	return b.String()
+}
+
+// Fetches versions oldest first. A failing version is recorded in the report and doesn't stop the others,
+// the returned error is only set when ctx ended the run early
+func (b *Backfill) Run(ctx context.Context, versions []VersionData) (*BackfillReport, error) {
+	start := time.Now()
+	report := &BackfillReport{Game: b.Game.Name, Succeeded: []string{}, Skipped: []string{}, Failed: make(map[string]string)}
+
+	versions = append([]VersionData(nil), versions...)
+	SortVersions(versions)
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+
+	concurrency := b.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	limiter := NewRateLimiter(b.Interval)
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		jobs = make(chan VersionData)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for version := range jobs {
+				err := b.fetch(ctx, limiter, version)
+				mu.Lock()
+				switch {
+				case err == nil:
+					report.Succeeded = append(report.Succeeded, version.Version.String())
+				case ctx.Err() == nil:
+					b.Updater.log.Error("Backfilling failed", "game", b.Game.Name, "version", version.Version, "err", err)
+					report.Failed[version.Version.String()] = err.Error()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, version := range versions {
+		if b.State != nil && b.State.Done(b.Game, version.Version) {
+			report.Skipped = append(report.Skipped, version.Version.String())
+			continue
+		}
+		select {
+		case jobs <- version:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sortVersionStrings(report.Succeeded)
+	report.Duration = time.Since(start)
+	return report, ctx.Err()
+}
+
+func (b *Backfill) fetch(ctx context.Context, limiter *RateLimiter, version VersionData) error {
+	if err := limiter.Wait(ctx); err != nil {
+		return err
+	}
+	release, err := b.Updater.Fetch(ctx, b.Game, version)
+	if err != nil {
+		return err
+	}
+	if !b.Keep && release.Manifest != nil {
+		release.Remove()
+	}
+	if b.State != nil {
+		return b.State.MarkDone(b.Game, version.Version)
+	}
+	return nil
+}
+
+// Sorts version strings oldest first, unparsable ones go last
+func sortVersionStrings(versions []string) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, errA := ParseVersion(versions[i])
+		b, errB := ParseVersion(versions[j])
+		if errA != nil || errB != nil {
+			return errA == nil
+		}
+		return a.Compare(b) < 0
+	})
+}
@@ -0,0 +1,124 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Puts an apktool on PATH that fakes a decompiled APK, failing for APKs whose path contains fail
+func fakeApktool(t *testing.T, fail string) {
+	t.Helper()
+	skipWithoutSh(t)
+	bin := t.TempDir()
+	script := `#!/bin/sh
+case "$2" in *` + fail + `*) echo "broken apk" >&2; exit 1;; esac
+mkdir -p "$5/assets/csv_logic"
+echo "decompiled $2" > "$5/assets/csv_logic/info.txt"
+echo '<manifest package="` + BrawlStars.Package + `"></manifest>' > "$5/AndroidManifest.xml"
+`
+	if err := os.WriteFile(filepath.Join(bin, "apktool"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestBackfill(t *testing.T) {
+	fakeApktool(t, "-1.2.0")
+	srv, _ := newFakeVersionsServer(t, 1, 3)
+	store, err := OpenStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	u := New(WithSource(testSource(srv.URL)), WithOutputRoot(out), WithStore(store), WithPageInterval(0))
+
+	versions, err := u.Versions(context.Background(), &BrawlStars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	state, err := LoadBackfillState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Backfill{Updater: u, Game: &BrawlStars, State: state, Concurrency: 2}
+
+	report, err := b.Run(context.Background(), versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Succeeded, []string{"1.1.0", "1.3.0"}) || len(report.Skipped) != 0 {
+		t.Errorf("report = %+v", report)
+	}
+	if msg := report.Failed["1.2.0"]; !strings.Contains(msg, "broken apk") && !strings.Contains(msg, "exit status 1") {
+		t.Errorf("1.2.0 failed with %q", msg)
+	}
+	stored, err := store.Versions(BrawlStars.Slug())
+	if err != nil || len(stored) != 2 {
+		t.Errorf("store has %v (%v), want the two successful versions", stored, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(out, "brawlstars-1.[13].0*")); len(leftovers) != 0 {
+		t.Errorf("working files of stored versions were left behind: %v", leftovers)
+	}
+
+	// A second run picks the state back up and only retries the failure
+	fakeApktool(t, "never")
+	state, err = LoadBackfillState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.State = state
+	report, err = b.Run(context.Background(), versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Succeeded, []string{"1.2.0"}) || !reflect.DeepEqual(report.Skipped, []string{"1.1.0", "1.3.0"}) || len(report.Failed) != 0 {
+		t.Errorf("resumed report = %+v", report)
+	}
+}
+
+func TestBackfillCancel(t *testing.T) {
+	fakeApktool(t, "never")
+	srv, _ := newFakeVersionsServer(t, 1, 3)
+	store, err := OpenStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := New(WithSource(testSource(srv.URL)), WithOutputRoot(t.TempDir()), WithStore(store))
+	versions, err := u.Versions(context.Background(), &BrawlStars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := (&Backfill{Updater: u, Game: &BrawlStars}).Run(ctx, versions)
+	if err == nil {
+		t.Fatal("Run() with a cancelled context should fail")
+	}
+	if len(report.Succeeded) != 0 || len(report.Failed) != 0 {
+		t.Errorf("cancelled backfill reported %+v", report)
+	}
+}
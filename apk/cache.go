@@ -0,0 +1,241 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// How long cached catalog pages are served without asking the mirror
+const DefaultCacheTTL = 15 * time.Minute
+
+// An http.RoundTripper that keeps catalog pages (HTML and JSON) on disk.
+// Fresh pages are served straight from disk, stale ones are revalidated with ETag/Last-Modified.
+// Anything else, like the APK itself or a request sent with Cache-Control: no-store, goes straight through without being buffered
+type CacheTransport struct {
+	Dir  string
+	TTL  time.Duration
+	Next http.RoundTripper
+	Log  *slog.Logger // optional, failures to write the cache are logged here
+}
+
+type cacheEntry struct {
+	URL      string      `json:"url"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	StoredAt time.Time   `json:"stored_at"`
+}
+
+func (c *CacheTransport) next() http.RoundTripper {
+	if c.Next != nil {
+		return c.Next
+	}
+	return http.DefaultTransport
+}
+
+func (c *CacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" || strings.Contains(req.Header.Get("Cache-Control"), "no-store") {
+		return c.next().RoundTrip(req)
+	}
+
+	key := cacheKey(req.URL.String())
+	entry, body, err := c.load(key)
+	if err == nil && time.Since(entry.StoredAt) < c.TTL {
+		return entry.response(req, body), nil
+	}
+
+	outReq := req
+	if err == nil {
+		outReq = req.Clone(req.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			outReq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			outReq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, rtErr := c.next().RoundTrip(outReq)
+	if rtErr != nil {
+		return nil, rtErr
+	}
+
+	if resp.StatusCode == http.StatusNotModified && err == nil {
+		resp.Body.Close()
+		entry.StoredAt = time.Now()
+		_ = c.store(key, entry, body)
+		return entry.response(req, body), nil
+	}
+
+	if resp.StatusCode != http.StatusOK || !isCatalogPage(resp) {
+		return resp, nil
+	}
+
+	fresh, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	entry = &cacheEntry{URL: req.URL.String(), Status: resp.StatusCode, Header: resp.Header, StoredAt: time.Now()}
+	if err := c.store(key, entry, fresh); err != nil && c.Log != nil {
+		c.Log.Warn("Couldn't cache page", "url", req.URL.String(), "err", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(fresh))
+	return resp, nil
+}
+
+func isCatalogPage(resp *http.Response) bool {
+	if strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		return false
+	}
+	contentType := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "json")
+}
+
+func (e *cacheEntry) response(req *http.Request, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func cacheKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *CacheTransport) load(key string) (*cacheEntry, []byte, error) {
+	meta, err := os.ReadFile(filepath.Join(c.Dir, key+".json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var entry cacheEntry
+	if err = json.Unmarshal(meta, &entry); err != nil {
+		return nil, nil, err
+	}
+	body, err := os.ReadFile(filepath.Join(c.Dir, key+".body"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &entry, body, nil
+}
+
+// Writes the body before the metadata so a half written entry is never loaded
+func (c *CacheTransport) store(key string, entry *cacheEntry, body []byte) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(filepath.Join(c.Dir, key+".body"), body); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(c.Dir, key+".json"), meta)
+}
+
+func writeFileAtomic(fp string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fp), filepath.Base(fp)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fp)
+}
+
+// Where the cache lives unless told otherwise, e.g. ~/.cache/apk-updater
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "apk-updater")
+}
+
+// Puts a disk cache in front of Default's client
+func EnableCache(dir string, ttl time.Duration) {
+	enableCache(Default.client, Default.log, dir, ttl)
+}
+
+func enableCache(client *retryablehttp.Client, logger *slog.Logger, dir string, ttl time.Duration) {
+	if _, ok := client.HTTPClient.Transport.(*CacheTransport); ok {
+		return
+	}
+	client.HTTPClient.Transport = &CacheTransport{Dir: dir, TTL: ttl, Next: client.HTTPClient.Transport, Log: logger}
+}
+
+// Removes every cached page. Only the files CacheTransport writes are touched, anything else in dir is left alone
+func ClearCache(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isCacheFile(entry.Name()) {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Matches key.json, key.body and their leftover temporary files
+func isCacheFile(name string) bool {
+	key, rest, _ := strings.Cut(name, ".")
+	if len(key) != sha256.Size*2 || strings.Trim(key, "0123456789abcdef") != "" {
+		return false
+	}
+	ext, _, _ := strings.Cut(rest, ".")
+	return ext == "json" || ext == "body"
+}
@@ -0,0 +1,134 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheTransport(t *testing.T) {
+	var pageHits, revalidations, apkHits int
+	body := "<html>v1</html>"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			pageHits++
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				revalidations++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = io.WriteString(w, body)
+		case "/app.apk":
+			apkHits++
+			w.Header().Set("Content-Type", "application/vnd.android.package-archive")
+			_, _ = io.WriteString(w, "PK")
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	transport := &CacheTransport{Dir: dir, TTL: time.Hour}
+	client := &http.Client{Transport: transport}
+	get := func(path string) string {
+		t.Helper()
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s status = %d", path, resp.StatusCode)
+		}
+		return string(b)
+	}
+
+	// Miss, then a fresh hit straight from disk
+	for i := 0; i < 2; i++ {
+		if got := get("/page"); got != body {
+			t.Errorf("GET /page = %q, want %q", got, body)
+		}
+	}
+	if pageHits != 1 {
+		t.Errorf("fresh pages should come from disk, server saw %d requests", pageHits)
+	}
+
+	// Stale, so it's revalidated and the 304 is answered from disk
+	transport.TTL = 0
+	if got := get("/page"); got != body {
+		t.Errorf("revalidated GET /page = %q, want %q", got, body)
+	}
+	if pageHits != 2 || revalidations != 1 {
+		t.Errorf("stale page should be revalidated once, got %d hits and %d revalidations", pageHits, revalidations)
+	}
+
+	// Downloads are never stored
+	transport.TTL = time.Hour
+	get("/app.apk")
+	get("/app.apk")
+	if apkHits != 2 {
+		t.Errorf("APKs shouldn't be cached, server saw %d requests", apkHits)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("cache dir has %d files, want the page's body and metadata only", len(entries))
+	}
+
+	// Pages asked for with no-store, like version pages with expiring download links, always hit the mirror
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/page", nil)
+		req.Header.Set("Cache-Control", "no-store")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if pageHits != 4 {
+		t.Errorf("no-store requests should skip the cache, server saw %d requests", pageHits)
+	}
+
+	// Clearing only removes what the cache wrote, even when dir is shared with other files
+	other := filepath.Join(dir, "backfill.json")
+	if err := os.WriteFile(other, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClearCache(dir); err != nil {
+		t.Fatalf("ClearCache() error = %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("cache dir has %d files after clearing, want only %s", len(entries), other)
+	}
+	get("/page")
+	if pageHits != 5 {
+		t.Errorf("cleared cache should refetch, server saw %d requests", pageHits)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// How many times a failed request is retried unless configured otherwise
+const DefaultHTTPRetries = 5
+
+// Settings for the clients NewHTTPClient builds, zero values keep the defaults
+type HTTPConfig struct {
+	Retries   int           `mapstructure:"retries"`
+	Timeout   time.Duration `mapstructure:"timeout"`    // for connecting and for the response headers of each attempt, bodies can take as long as they need. 0 means no timeout
+	UserAgent string        `mapstructure:"user_agent"` // sent with every request, empty keeps Go's (a browser's for downloads)
+	Proxy     string        `mapstructure:"proxy"`      // empty uses HTTP_PROXY and friends
+	Record    string        `mapstructure:"record"`     // saves every exchange to this folder, see RecordTransport
+	Replay    string        `mapstructure:"replay"`     // answers from a recording in this folder instead of the network, see ReplayTransport
+}
+
+// Builds a retrying client from cfg
+func NewHTTPClient(cfg HTTPConfig) (*retryablehttp.Client, error) {
+	client := retryablehttp.NewClient()
+	client.Logger = nil
+	client.RetryMax = cfg.Retries
+
+	transport, ok := client.HTTPClient.Transport.(*http.Transport)
+	if cfg.Timeout > 0 && ok {
+		// Not http.Client.Timeout, it would also cut off an APK download that's still streaming
+		transport.DialContext = (&net.Dialer{Timeout: cfg.Timeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = cfg.Timeout
+		transport.ResponseHeaderTimeout = cfg.Timeout
+	}
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", cfg.Proxy)
+		}
+		if ok {
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+	}
+	if cfg.UserAgent != "" {
+		client.HTTPClient.Transport = &userAgentTransport{agent: cfg.UserAgent, next: client.HTTPClient.Transport}
+	}
+
+	if cfg.Record != "" && cfg.Replay != "" {
+		return nil, fmt.Errorf("can't record and replay at the same time")
+	}
+	if cfg.Record != "" {
+		client.HTTPClient.Transport = &RecordTransport{Dir: cfg.Record, Next: client.HTTPClient.Transport}
+	}
+	if cfg.Replay != "" {
+		client.HTTPClient.Transport = &ReplayTransport{Dir: cfg.Replay}
+		client.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+			if errors.Is(err, ErrNotRecorded) {
+				return false, err // retrying won't make it appear
+			}
+			return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+		}
+	}
+	return client, nil
+}
+
+type userAgentTransport struct {
+	agent string
+	next  http.RoundTripper
+}
+
+// The configured agent wins over one set on the request, like the browser agent downloads are sent with
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != t.agent {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.agent)
+	}
+	return t.next.RoundTrip(req)
+}
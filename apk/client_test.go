@@ -0,0 +1,93 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+func TestHTTPClientTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-headers" {
+			time.Sleep(300 * time.Millisecond)
+			return
+		}
+		// Headers straight away, then a body that takes longer than the timeout
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 6; i++ {
+			_, _ = w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := NewHTTPClient(HTTPConfig{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(srv.URL + "/slow-body")
+	if err != nil {
+		t.Fatalf("GET /slow-body error = %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 6*len("chunk") {
+		t.Errorf("a body streaming past the timeout was cut off after %d bytes: %v", len(body), err)
+	}
+
+	if resp, err := client.Get(srv.URL + "/slow-headers"); err == nil {
+		resp.Body.Close()
+		t.Error("GET /slow-headers should time out waiting for the headers")
+	}
+}
+
+func TestHTTPClientUserAgent(t *testing.T) {
+	agents := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.UserAgent()
+	}))
+	defer srv.Close()
+
+	client, err := NewHTTPClient(HTTPConfig{UserAgent: "apk-updater-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Set like WgetAPK's browser agent, the configured one still wins
+	req, err := retryablehttp.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := <-agents; got != "apk-updater-test" {
+		t.Errorf("server saw User-Agent %q, want the configured one", got)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// One column of a game CSV, e.g. Name of type String
+type CSVColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// A game CSV with its values typed. Supercell CSVs start with a row of column names followed by a row of
+// column types (String, int, Boolean), every row after that is data
+type CSVTable struct {
+	Columns []CSVColumn      `json:"columns"`
+	Rows    []map[string]any `json:"rows"` // empty cells are left out
+}
+
+// Reads a decompressed game CSV, ints and booleans become numbers and bools and anything else stays a string.
+// A value that doesn't parse as its column's type is kept as a string rather than failing the whole table
+func ParseCSVTable(r io.Reader) (*CSVTable, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	names, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the header row: %w", err)
+	}
+	types, err := reader.Read()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading the type row: %w", err)
+	}
+
+	table := &CSVTable{Columns: make([]CSVColumn, len(names)), Rows: []map[string]any{}}
+	for i, name := range names {
+		table.Columns[i].Name = name
+		if i < len(types) {
+			table.Columns[i].Type = types[i]
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return table, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]any, len(record))
+		for i, value := range record {
+			if i >= len(table.Columns) || value == "" {
+				continue
+			}
+			row[table.Columns[i].Name] = typedValue(table.Columns[i].Type, value)
+		}
+		table.Rows = append(table.Rows, row)
+	}
+}
+
+func typedValue(kind, value string) any {
+	switch strings.ToLower(kind) {
+	case "int":
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
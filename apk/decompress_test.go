@@ -0,0 +1,127 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Decompresses the corpus in testdata/decompress (see gen.go there) and compares the result with expected/
+func TestDecompressGolden(t *testing.T) {
+	root := filepath.Join("testdata", "decompress")
+	decompiled := t.TempDir()
+	if err := copyTree(filepath.Join(root, "assets"), filepath.Join(decompiled, "assets")); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+
+	sink := &recordedEvents{}
+	u := New(WithProgress(NoProgress{}), WithEvents(sink), WithLogger(NewLoggerTo(&bytes.Buffer{})))
+	counts, err := u.DecompressAssets(context.Background(), []string{"csv_logic", "localization", "missing"}, decompiled, out)
+	if err != nil {
+		t.Fatalf("DecompressAssets() error = %v", err)
+	}
+
+	want := readTree(t, filepath.Join(root, "expected"))
+	got := readTree(t, out)
+	if !reflect.DeepEqual(keys(got), keys(want)) {
+		t.Errorf("output files = %v, want %v", keys(got), keys(want))
+	}
+	for path, data := range want {
+		if got[path] != data {
+			t.Errorf("%s = %q, want %q", path, got[path], data)
+		}
+	}
+
+	wantFailed := []string{"csv_logic/garbage.csv", "csv_logic/lzham.csv", "csv_logic/sc_zstd.csv", "csv_logic/tiny.csv", "csv_logic/truncated.csv", "csv_logic/zstd.csv"}
+	var failed []string
+	for _, e := range sink.events {
+		if e.Event == EventAsset && e.Status == AssetFailed {
+			if e.Error == "" {
+				t.Errorf("%s failed without an error", e.File)
+			}
+			failed = append(failed, e.File)
+		}
+	}
+	sort.Strings(failed)
+	if !reflect.DeepEqual(failed, wantFailed) {
+		t.Errorf("failed = %v, want %v", failed, wantFailed)
+	}
+	if counts.Decompressed != len(want) || counts.Failed != len(wantFailed) {
+		t.Errorf("counts = %+v, want %d decompressed and %d failed", counts, len(want), len(wantFailed))
+	}
+}
+
+func TestDecompressFileFormats(t *testing.T) {
+	assets := filepath.Join("testdata", "decompress", "assets", "csv_logic")
+	tests := map[string]string{
+		"lzma.csv":    "lzma",
+		"sc.csv":      "sc",
+		"sig.csv":     "sig",
+		"plain.csv":   "none",
+		"empty.csv":   "none",
+		"lzham.csv":   "sclz",
+		"zstd.csv":    "zstd",
+		"sc_zstd.csv": "zstd",
+	}
+	for file, want := range tests {
+		format, _ := decompressFile(filepath.Join(assets, file), filepath.Join(t.TempDir(), file))
+		if format != want {
+			t.Errorf("decompressFile(%s) format = %s, want %s", file, format, want)
+		}
+	}
+}
+
+// Every regular file under root keyed by its slash separated path
+func readTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func keys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,103 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"time"
+)
+
+// Pipeline event types, see Event
+const (
+	EventVersionResolved = "version_resolved"
+	EventDecompileStart  = "decompile_start"
+	EventDecompileDone   = "decompile_done"
+	EventAsset           = "asset"
+	EventSummary         = "summary"
+)
+
+// Asset statuses of an EventAsset
+const (
+	AssetDecompressed = "decompressed"
+	AssetFailed       = "failed"
+)
+
+// Something that happened in the pipeline. Only the fields that make sense for the event are set
+type Event struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Game    string    `json:"game,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Date    string    `json:"date,omitempty"`
+	URL     string    `json:"url,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	File    string    `json:"file,omitempty"`
+	Status  string    `json:"status,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Summary *Summary  `json:"summary,omitempty"`
+}
+
+// The outcome of a whole run, sent as the last event
+type Summary struct {
+	APKPath        string  `json:"apk_path,omitempty"`
+	DecompiledPath string  `json:"decompiled_path,omitempty"`
+	AssetsPath     string  `json:"assets_path,omitempty"`
+	Decompressed   int     `json:"decompressed"`
+	Failed         int     `json:"failed"`
+	Seconds        float64 `json:"seconds"` // how long the run took
+}
+
+// Receives pipeline events as they happen
+type EventSink interface {
+	Emit(e Event)
+}
+
+// Sends e to the updater's event sink, if it has one
+func (u *Updater) Emit(e Event) {
+	if u.events == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	u.events.Emit(e)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Builds the event sent once the download link of a version is known
+func ResolvedEvent(game *GameLink, version VersionData, url string) Event {
+	return Event{Event: EventVersionResolved, Game: game.Name, Version: version.Version.String(), Date: version.Date, URL: url}
+}
+
+// Builds the summary event of a run that started at start
+func SummaryEvent(game *GameLink, version Version, start time.Time, summary Summary, err error) Event {
+	summary.Seconds = time.Since(start).Seconds()
+	return Event{
+		Event:   EventSummary,
+		Game:    game.Name,
+		Version: version.String(),
+		Error:   errorString(err),
+		Summary: &summary,
+	}
+}
@@ -0,0 +1,90 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordedEvents struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recordedEvents) Emit(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func TestFetchEmitsEvents(t *testing.T) {
+	fakeApktool(t, "never")
+	srv, _ := newFakeVersionsServer(t, 1, 1)
+	sink := &recordedEvents{}
+	u := New(WithSource(testSource(srv.URL)), WithOutputRoot(t.TempDir()), WithEvents(sink), WithProgress(NoProgress{}))
+
+	release, err := u.Fetch(context.Background(), &BrawlStars, VersionData{Version: MustParseVersion("1.1.0"), URL: srv.URL + "/app/1", Date: "Jan 1, 2022"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	for _, e := range sink.events {
+		types = append(types, e.Event)
+	}
+	want := []string{EventVersionResolved, EventDecompileStart, EventDecompileDone, EventAsset, EventSummary}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Fatalf("events = %v, want %v", types, want)
+	}
+
+	resolved := sink.events[0]
+	if resolved.Game != "Brawl Stars" || resolved.Version != "1.1.0" || resolved.Date != "Jan 1, 2022" || !strings.HasSuffix(resolved.URL, "/dl/app/1") {
+		t.Errorf("version_resolved = %+v", resolved)
+	}
+	// Uncompressed files are passed through as is
+	if asset := sink.events[3]; asset.File != "csv_logic/info.txt" || asset.Status != AssetDecompressed || asset.Error != "" {
+		t.Errorf("asset = %+v", asset)
+	}
+	summary := sink.events[4]
+	if summary.Error != "" || summary.Summary == nil || summary.Summary.Decompressed != 1 || summary.Summary.AssetsPath != release.AssetsPath || summary.Summary.APKPath != filepath.Join(u.OutputRoot(), "brawlstars-1.1.0.apk") {
+		t.Errorf("summary = %+v (%+v)", summary, summary.Summary)
+	}
+}
+
+func TestJSONProgressIsAnEventSink(t *testing.T) {
+	var out bytes.Buffer
+	stream := NewJSONProgress(&out)
+	stream.Emit(Event{Event: EventDecompileStart, Path: "a.apk"})
+	stream.Start("Downloading", Bytes, 10).Finish(nil)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3:\n%s", len(lines), out.String())
+	}
+	var first map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || first["event"] != EventDecompileStart || first["path"] != "a.apk" {
+		t.Errorf("first line = %s (%v)", lines[0], err)
+	}
+}
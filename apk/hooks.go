@@ -0,0 +1,153 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// A point in the pipeline hook commands can run at
+type HookEvent string
+
+const (
+	OnDownload   HookEvent = "on_download"
+	OnDecompile  HookEvent = "on_decompile"
+	OnDecompress HookEvent = "on_decompress"
+	OnError      HookEvent = "on_error"
+)
+
+// How long a hook command may run unless Hooks.Timeout says otherwise
+const DefaultHookTimeout = 5 * time.Minute
+
+// Shell commands to run after each pipeline step, through sh -c (cmd /C on Windows).
+// Every command sees the APK_UPDATER_* variables described by HookContext
+type Hooks struct {
+	OnDownload   []string      `mapstructure:"on_download"`
+	OnDecompile  []string      `mapstructure:"on_decompile"`
+	OnDecompress []string      `mapstructure:"on_decompress"`
+	OnError      []string      `mapstructure:"on_error"`
+	Timeout      time.Duration `mapstructure:"timeout"`
+}
+
+// What a hook gets told about, each field ends up in an environment variable
+type HookContext struct {
+	Game           string // APK_UPDATER_GAME
+	Version        string // APK_UPDATER_VERSION
+	APKPath        string // APK_UPDATER_APK_PATH
+	DecompiledPath string // APK_UPDATER_DECOMPILED_PATH
+	AssetsPath     string // APK_UPDATER_ASSETS_PATH
+	Err            error  // APK_UPDATER_ERROR, only set for on_error
+}
+
+func (hc HookContext) env(event HookEvent) []string {
+	env := []string{
+		"APK_UPDATER_EVENT=" + string(event),
+		"APK_UPDATER_GAME=" + hc.Game,
+		"APK_UPDATER_VERSION=" + hc.Version,
+		"APK_UPDATER_APK_PATH=" + hc.APKPath,
+		"APK_UPDATER_DECOMPILED_PATH=" + hc.DecompiledPath,
+		"APK_UPDATER_ASSETS_PATH=" + hc.AssetsPath,
+	}
+	if hc.Err != nil {
+		env = append(env, "APK_UPDATER_ERROR="+hc.Err.Error())
+	}
+	return env
+}
+
+func (h *Hooks) commands(event HookEvent) []string {
+	if h == nil {
+		return nil
+	}
+	switch event {
+	case OnDownload:
+		return h.OnDownload
+	case OnDecompile:
+		return h.OnDecompile
+	case OnDecompress:
+		return h.OnDecompress
+	case OnError:
+		return h.OnError
+	}
+	return nil
+}
+
+// Runs the event's commands one after another, logging their output. Every command runs even if
+// an earlier one failed, the failures are returned together
+func (h *Hooks) Run(ctx context.Context, logger *slog.Logger, event HookEvent, hc HookContext) error {
+	var errs []string
+	for _, command := range h.commands(event) {
+		if err := h.run(ctx, logger, event, command, hc); err != nil {
+			logger.Error("Hook failed", "event", event, "command", command, "game", hc.Game, "version", hc.Version, "err", err)
+			errs = append(errs, fmt.Sprintf("%s: %s", command, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s hooks failed: %s", event, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (h *Hooks) run(ctx context.Context, logger *slog.Logger, event HookEvent, command string, hc HookContext) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	logger.Info("Running hook", "event", event, "command", command, "game", hc.Game, "version", hc.Version)
+	var output bytes.Buffer
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(), hc.env(event)...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		err = ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+	}
+
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		logger.Info(scanner.Text(), "event", event, "command", command)
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func skipWithoutSh(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("hook tests use sh")
+	}
+}
+
+func TestHooksEnvironment(t *testing.T) {
+	skipWithoutSh(t)
+	out := filepath.Join(t.TempDir(), "env")
+	hooks := &Hooks{OnError: []string{`echo "$APK_UPDATER_EVENT|$APK_UPDATER_GAME|$APK_UPDATER_VERSION|$APK_UPDATER_APK_PATH|$APK_UPDATER_ASSETS_PATH|$APK_UPDATER_ERROR" > ` + out}}
+
+	hc := HookContext{Game: "Hay Day", Version: "1.2.3", APKPath: "hayday-1.2.3.apk", AssetsPath: "hayday-1.2.3-decompressed", Err: errors.New("boom")}
+	if err := hooks.Run(context.Background(), Log, OnError, hc); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "on_error|Hay Day|1.2.3|hayday-1.2.3.apk|hayday-1.2.3-decompressed|boom"
+	if strings.TrimSpace(string(got)) != want {
+		t.Errorf("hook saw %q, want %q", strings.TrimSpace(string(got)), want)
+	}
+}
+
+func TestHooksFailuresAndTimeout(t *testing.T) {
+	skipWithoutSh(t)
+	marker := filepath.Join(t.TempDir(), "ran")
+	hooks := &Hooks{
+		OnDownload: []string{"exit 3", "sleep 10", "touch " + marker},
+		Timeout:    200 * time.Millisecond,
+	}
+
+	start := time.Now()
+	err := hooks.Run(context.Background(), Log, OnDownload, HookContext{})
+	if err == nil {
+		t.Fatal("Run() should report the failing and timed out commands")
+	}
+	if !strings.Contains(err.Error(), "exit 3") || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Run() error = %v, want both failures", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("the timeout didn't kill sleep")
+	}
+	if _, err = os.Stat(marker); err != nil {
+		t.Error("commands after a failing one should still run")
+	}
+}
+
+func TestFetchRunsHooks(t *testing.T) {
+	skipWithoutSh(t)
+	srv, _ := newFakeVersionsServer(t, 1, 1)
+	dir := t.TempDir()
+	hooks := &Hooks{
+		OnDownload: []string{`echo "$APK_UPDATER_APK_PATH" > ` + filepath.Join(dir, "downloaded")},
+		OnError:    []string{`echo "$APK_UPDATER_ERROR" > ` + filepath.Join(dir, "failed")},
+	}
+	u := New(WithSource(testSource(srv.URL)), WithOutputRoot(dir), WithHooks(hooks))
+
+	// The fake APK downloads fine but can't be decompiled
+	if _, err := u.Fetch(context.Background(), &BrawlStars, VersionData{Version: MustParseVersion("1.1.0"), URL: srv.URL + "/app/1"}); err == nil {
+		t.Fatal("Fetch() of a broken APK should fail")
+	}
+
+	downloaded, err := os.ReadFile(filepath.Join(dir, "downloaded"))
+	if err != nil || strings.TrimSpace(string(downloaded)) != filepath.Join(dir, "brawlstars-1.1.0.apk") {
+		t.Errorf("on_download hook saw %q (%v)", downloaded, err)
+	}
+	if failed, err := os.ReadFile(filepath.Join(dir, "failed")); err != nil || len(strings.TrimSpace(string(failed))) == 0 {
+		t.Errorf("on_error hook didn't get the error (%v)", err)
+	}
+}
+
+func TestDecompressDecompiledRunsHooks(t *testing.T) {
+	skipWithoutSh(t)
+	dir := t.TempDir()
+	decompiled := filepath.Join(dir, "app")
+	writeTree(t, decompiled, map[string]string{"assets/csv/a.csv": "a,b"})
+	hooks := &Hooks{
+		OnDecompress: []string{`echo "$APK_UPDATER_ASSETS_PATH" > ` + filepath.Join(dir, "decompressed")},
+		OnError:      []string{`echo "$APK_UPDATER_ERROR" > ` + filepath.Join(dir, "failed")},
+	}
+	u := New(WithHooks(hooks), WithProgress(NoProgress{}))
+	game := &GameLink{Name: "Test", ValidDirectories: []string{"csv"}}
+
+	out := filepath.Join(dir, "out")
+	release, err := u.DecompressDecompiled(context.Background(), game, decompiled, out)
+	if err != nil || release.AssetsPath != out {
+		t.Fatalf("DecompressDecompiled() = %v, %v", release, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "decompressed")); err != nil || strings.TrimSpace(string(got)) != out {
+		t.Errorf("on_decompress hook saw %q (%v)", got, err)
+	}
+
+	// An output folder that can't be created fails the run
+	if _, err := u.DecompressDecompiled(context.Background(), game, decompiled, filepath.Join(dir, "missing", "out")); err == nil {
+		t.Fatal("DecompressDecompiled() into a missing folder should fail")
+	}
+	if failed, err := os.ReadFile(filepath.Join(dir, "failed")); err != nil || len(strings.TrimSpace(string(failed))) == 0 {
+		t.Errorf("on_error hook didn't get the error (%v)", err)
+	}
+}
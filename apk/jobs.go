@@ -0,0 +1,399 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+const (
+	// How many pipeline runs a job queue works on at once unless told otherwise
+	DefaultJobWorkers = 2
+	// Log lines kept per job, older ones are dropped
+	MaxJobLogLines = 200
+	// Finished jobs kept in the database, the oldest are dropped first
+	MaxFinishedJobs = 500
+)
+
+// One download, decompile and decompress run of a game version
+type Job struct {
+	ID       string     `json:"id"`
+	Game     string     `json:"game"` // slug
+	Version  string     `json:"version"`
+	URL      string     `json:"url"` // version page the download link is resolved from
+	Date     string     `json:"date,omitempty"`
+	Status   JobStatus  `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  time.Time  `json:"started"`
+	Finished time.Time  `json:"finished"`
+	Result   *JobResult `json:"result,omitempty"`
+	Logs     []string   `json:"logs"`
+
+	done chan struct{} // closed once the job succeeded or failed
+}
+
+// Where a finished job left its output, the working files are only there if the queue keeps them
+type JobResult struct {
+	APKPath        string      `json:"apk_path,omitempty"`
+	DecompiledPath string      `json:"decompiled_path,omitempty"`
+	AssetsPath     string      `json:"assets_path,omitempty"`
+	Assets         AssetCounts `json:"assets"`
+	Files          int         `json:"files"` // files in the stored manifest
+}
+
+func (j *Job) key() string {
+	return j.Game + "@" + j.Version
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
+
+// A copy that's safe to hand out while the queue keeps working on the job
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Logs = append([]string(nil), j.Logs...)
+	if j.Result != nil {
+		result := *j.Result
+		c.Result = &result
+	}
+	c.done = nil
+	return c
+}
+
+// Runs pipeline jobs on a bounded pool of workers. Submitting a version that is already queued or running
+// returns the existing job, and every job is kept in a JSON file so queued and interrupted jobs are picked
+// up again after a restart
+type JobQueue struct {
+	Updater *Updater
+	Workers int
+	Keep    bool // keep the APK and decompiled files of finished jobs, otherwise only the store has the assets
+
+	path    string
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	order   []string        // job IDs, oldest first
+	active  map[string]*Job // queued or running jobs by game@version
+	pending []*Job          // queued jobs, oldest first
+	wake    chan struct{}
+	lastID  int
+}
+
+// Where the job database lives next to a store
+func DefaultJobsFile(store *Store) string {
+	return filepath.Join(store.Dir, "jobs.json")
+}
+
+// Loads the job database at path, a missing file is an empty queue. Jobs that were queued or running when
+// the database was last written are queued again
+func OpenJobQueue(u *Updater, path string) (*JobQueue, error) {
+	q := &JobQueue{
+		Updater: u,
+		Workers: DefaultJobWorkers,
+		path:    path,
+		jobs:    make(map[string]*Job),
+		active:  make(map[string]*Job),
+		wake:    make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var db struct {
+		Jobs []*Job `json:"jobs"`
+	}
+	if err = json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("reading job database %s: %w", path, err)
+	}
+	for _, job := range db.Jobs {
+		job.done = make(chan struct{})
+		if job.finished() {
+			close(job.done)
+		} else {
+			job.Status, job.Started = JobQueued, time.Time{}
+			q.active[job.key()] = job
+			q.pending = append(q.pending, job)
+		}
+		q.jobs[job.ID] = job
+		q.order = append(q.order, job.ID)
+		if id, err := strconv.Atoi(job.ID); err == nil && id > q.lastID {
+			q.lastID = id
+		}
+	}
+	return q, nil
+}
+
+// Queues a fetch of version, or returns the queued or running job for the same version.
+// created reports whether a new job was queued
+func (q *JobQueue) Submit(game *GameLink, version VersionData) (job Job, created bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := game.Slug() + "@" + version.Version.String()
+	if existing, ok := q.active[key]; ok {
+		return existing.snapshot(), false, nil
+	}
+
+	q.lastID++
+	j := &Job{
+		ID:      strconv.Itoa(q.lastID),
+		Game:    game.Slug(),
+		Version: version.Version.String(),
+		URL:     version.URL,
+		Date:    version.Date,
+		Status:  JobQueued,
+		Created: time.Now(),
+		Logs:    []string{},
+		done:    make(chan struct{}),
+	}
+	// Only queued once it's saved, a job the client was told failed must never run
+	q.jobs[j.ID] = j
+	q.order = append(q.order, j.ID)
+	if err = q.save(); err != nil {
+		delete(q.jobs, j.ID)
+		q.order = q.order[:len(q.order)-1]
+		q.lastID--
+		return Job{}, false, err
+	}
+	q.active[key] = j
+	q.pending = append(q.pending, j)
+	q.signal()
+	return j.snapshot(), true, nil
+}
+
+// Looks a job up by its ID
+func (q *JobQueue) Job(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+// Every job, newest first
+func (q *JobQueue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, 0, len(q.order))
+	for i := len(q.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, q.jobs[q.order[i]].snapshot())
+	}
+	return jobs
+}
+
+// Waits until the job succeeded or failed, or ctx is done
+func (q *JobQueue) Wait(ctx context.Context, id string) (Job, error) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	q.mu.Unlock()
+	if !ok {
+		return Job{}, fmt.Errorf("no job %s", id)
+	}
+	select {
+	case <-job.done:
+		j, _ := q.Job(id)
+		return j, nil
+	case <-ctx.Done():
+		return Job{}, ctx.Err()
+	}
+}
+
+// Works through the queue until ctx is done. Jobs cut short by ctx are queued again in the database
+func (q *JobQueue) Run(ctx context.Context) {
+	workers := q.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := q.next(ctx); job != nil; job = q.next(ctx) {
+				q.process(ctx, job)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Wakes a worker, a no-op when one is already being woken
+func (q *JobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Takes the oldest queued job and marks it running, nil once ctx is done
+func (q *JobQueue) next(ctx context.Context) *Job {
+	for {
+		q.mu.Lock()
+		if ctx.Err() == nil && len(q.pending) > 0 {
+			job := q.pending[0]
+			q.pending = q.pending[1:]
+			if len(q.pending) > 0 {
+				q.signal() // another worker may be idle
+			}
+			job.Status, job.Started = JobRunning, time.Now()
+			q.saveOrLog()
+			q.mu.Unlock()
+			return job
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-q.wake:
+		}
+	}
+}
+
+func (q *JobQueue) process(ctx context.Context, job *Job) {
+	game, ok := FindGame(job.Game)
+	var release *Release
+	err := fmt.Errorf("unknown game %q", job.Game)
+	if ok {
+		var version Version
+		if version, err = ParseVersion(job.Version); err == nil {
+			logger := slog.New(multiHandler{q.Updater.log.Handler(), slog.NewTextHandler(&jobLog{q: q, job: job}, nil)})
+			u := q.Updater.derive(WithLogger(logger.With("job", job.ID)))
+			release, err = u.Fetch(ctx, game, VersionData{Version: version, URL: job.URL, Date: job.Date})
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ctx.Err() != nil {
+		// Stopped, not failed: the next run picks it up again
+		job.Status, job.Started = JobQueued, time.Time{}
+		q.saveOrLog()
+		return
+	}
+
+	job.Finished = time.Now()
+	if err != nil {
+		job.Status, job.Error = JobFailed, err.Error()
+	} else {
+		job.Status = JobSucceeded
+		job.Result = &JobResult{Assets: release.Assets}
+		if release.Manifest != nil {
+			job.Result.Files = len(release.Manifest.Files)
+		}
+		if q.Keep || release.Manifest == nil {
+			job.Result.APKPath, job.Result.DecompiledPath, job.Result.AssetsPath = release.APKPath, release.DecompiledPath, release.AssetsPath
+		} else {
+			release.Remove()
+		}
+	}
+	delete(q.active, job.key())
+	close(job.done)
+	q.prune()
+	q.saveOrLog()
+}
+
+// Drops the oldest finished jobs past MaxFinishedJobs, q.mu must be held
+func (q *JobQueue) prune() {
+	finished := 0
+	for _, id := range q.order {
+		if q.jobs[id].finished() {
+			finished++
+		}
+	}
+	order := q.order[:0]
+	for _, id := range q.order {
+		if finished > MaxFinishedJobs && q.jobs[id].finished() {
+			delete(q.jobs, id)
+			finished--
+			continue
+		}
+		order = append(order, id)
+	}
+	q.order = order
+}
+
+// Writes the database, q.mu must be held
+func (q *JobQueue) save() error {
+	jobs := make([]*Job, 0, len(q.order))
+	for _, id := range q.order {
+		jobs = append(jobs, q.jobs[id])
+	}
+	data, err := json.MarshalIndent(struct {
+		Jobs []*Job `json:"jobs"`
+	}{jobs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path, data)
+}
+
+// Like save, for status changes that can't be refused anymore
+func (q *JobQueue) saveOrLog() {
+	if err := q.save(); err != nil {
+		q.Updater.log.Error("Saving the job database failed", "path", q.path, "err", err)
+	}
+}
+
+// Collects the log lines of a job
+type jobLog struct {
+	q   *JobQueue
+	job *Job
+}
+
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.q.mu.Lock()
+	defer l.q.mu.Unlock()
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		l.job.Logs = append(l.job.Logs, string(line))
+	}
+	if extra := len(l.job.Logs) - MaxJobLogLines; extra > 0 {
+		l.job.Logs = append(l.job.Logs[:0], l.job.Logs[extra:]...)
+	}
+	return len(p), nil
+}
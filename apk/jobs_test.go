@@ -0,0 +1,133 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJobQueueCoalesces(t *testing.T) {
+	fakeApktool(t, "-1.2.0")
+	srv, _ := newFakeVersionsServer(t, 1, 2)
+	store, err := OpenStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	u := New(WithSource(testSource(srv.URL)), WithOutputRoot(out), WithStore(store), WithProgress(NoProgress{}))
+	q, err := OpenJobQueue(u, DefaultJobsFile(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := u.Versions(context.Background(), &BrawlStars)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Versions() = %v, %v", versions, err)
+	}
+	good, bad := versions[1], versions[0] // 1.1.0 and 1.2.0
+
+	first, created, err := q.Submit(&BrawlStars, good)
+	if err != nil || !created {
+		t.Fatalf("Submit() = %v, %v", created, err)
+	}
+	again, created, _ := q.Submit(&BrawlStars, good)
+	if created || again.ID != first.ID {
+		t.Errorf("duplicate Submit() made job %s, want %s", again.ID, first.ID)
+	}
+	failing, _, _ := q.Submit(&BrawlStars, bad)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	done, err := q.Wait(ctx, first.ID)
+	if err != nil || done.Status != JobSucceeded || done.Result == nil || done.Result.Files != 1 {
+		t.Fatalf("job = %+v, %v, want succeeded with one stored file", done, err)
+	}
+	if _, err = os.Stat(filepath.Join(out, "brawlstars-1.1.0.apk")); !os.IsNotExist(err) {
+		t.Errorf("working files weren't removed: %v", err)
+	}
+	if failed, _ := q.Wait(ctx, failing.ID); failed.Status != JobFailed || failed.Error == "" {
+		t.Errorf("job = %+v, want failed", failed)
+	}
+
+	// Finished, so the same version gets a new job
+	if _, created, _ = q.Submit(&BrawlStars, good); !created {
+		t.Error("Submit() after the job finished should queue a new one")
+	}
+}
+
+func TestJobQueuePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	q, err := OpenJobQueue(New(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, _, err := q.Submit(&ClashRoyale, VersionData{Version: MustParseVersion("5.0.0"), URL: "https://example.com/app/5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenJobQueue(New(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, ok := reopened.Job(queued.ID)
+	if !ok || job.Status != JobQueued || job.URL != "https://example.com/app/5" {
+		t.Fatalf("reopened job = %+v, %v", job, ok)
+	}
+	if _, created, _ := reopened.Submit(&ClashRoyale, VersionData{Version: MustParseVersion("5.0.0")}); created {
+		t.Error("a job queued before the restart should still coalesce")
+	}
+	next, _, _ := reopened.Submit(&ClashRoyale, VersionData{Version: MustParseVersion("5.1.0")})
+	if next.ID == queued.ID {
+		t.Errorf("new job reused ID %s", next.ID)
+	}
+}
+
+func TestJobQueueSubmitSaveFails(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenJobQueue(New(), filepath.Join(dir, "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := q.path
+	q.path = filepath.Join(dir, "jobs.json", "jobs.json") // can't be written, jobs.json isn't a folder
+	if err = os.WriteFile(filepath.Join(dir, "jobs.json"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	version := VersionData{Version: MustParseVersion("5.0.0"), URL: "https://example.com/app/5"}
+	if _, _, err = q.Submit(&ClashRoyale, version); err == nil {
+		t.Fatal("Submit() should fail when the job can't be saved")
+	}
+	if jobs := q.Jobs(); len(jobs) != 0 || len(q.pending) != 0 {
+		t.Fatalf("a job that wasn't saved is still queued: %+v", jobs)
+	}
+
+	// The same version is queued afresh once saving works again
+	q.path = good
+	job, created, err := q.Submit(&ClashRoyale, version)
+	if err != nil || !created || job.ID != "1" {
+		t.Errorf("Submit() = %+v, %v, %v, want a new job 1", job, created, err)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log formats that can be picked by name
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// Where and how NewConfiguredLogger logs
+type LogConfig struct {
+	Level  string `mapstructure:"level"`  // debug, info, warn or error
+	Format string `mapstructure:"format"` // text or json
+	File   string `mapstructure:"file"`   // also append every line to this file when set
+}
+
+// Logs text lines at info level and up to stdout
+func NewLogger() *slog.Logger {
+	return NewLoggerTo(os.Stdout)
+}
+
+// Like NewLogger but writes to w, e.g. os.Stderr when stdout carries machine readable output
+func NewLoggerTo(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, nil))
+}
+
+// Builds a logger writing to console in cfg's format and level, plus cfg.File when set.
+// The returned closer closes the log file and is never nil
+func NewConfiguredLogger(cfg LogConfig, console io.Writer) (*slog.Logger, io.Closer, error) {
+	level, err := ParseLogLevel(cfg.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	newHandler := func(w io.Writer) (slog.Handler, error) {
+		switch strings.ToLower(cfg.Format) {
+		case LogText, "":
+			return slog.NewTextHandler(w, opts), nil
+		case LogJSON:
+			return slog.NewJSONHandler(w, opts), nil
+		default:
+			return nil, fmt.Errorf("unknown log format %q, expected text or json", cfg.Format)
+		}
+	}
+
+	handler, err := newHandler(console)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.File == "" {
+		return slog.New(handler), io.NopCloser(nil), nil
+	}
+
+	f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening log file: %w", err)
+	}
+	fileHandler, _ := newHandler(f) // the format was checked above
+	return slog.New(multiHandler{handler, fileHandler}), f, nil
+}
+
+// Parses debug, info, warn or error, an empty level is info
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// Sends every record to each handler
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
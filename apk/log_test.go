@@ -0,0 +1,81 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfiguredLogger(t *testing.T) {
+	var console bytes.Buffer
+	file := filepath.Join(t.TempDir(), "apk-updater.log")
+	logger, closer, err := NewConfiguredLogger(LogConfig{Level: "warn", Format: LogJSON, File: file}, &console)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("Fetching versions page", "url", "https://example.com")
+	logger.With("game", "Clash of Clans").Warn("Skipping version", "version", "15.0.1")
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if console.String() != string(written) {
+		t.Errorf("file got %q, console got %q", written, console.String())
+	}
+	lines := strings.Split(strings.TrimSpace(console.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want only the warning: %q", len(lines), console.String())
+	}
+	var line map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["level"] != "WARN" || line["msg"] != "Skipping version" || line["game"] != "Clash of Clans" || line["version"] != "15.0.1" {
+		t.Errorf("unexpected line %v", line)
+	}
+}
+
+func TestConfiguredLoggerErrors(t *testing.T) {
+	if _, _, err := NewConfiguredLogger(LogConfig{Level: "loud"}, &bytes.Buffer{}); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+	if _, _, err := NewConfiguredLogger(LogConfig{Format: "xml"}, &bytes.Buffer{}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+
+	var console bytes.Buffer
+	logger, _, err := NewConfiguredLogger(LogConfig{}, &console)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("hidden")
+	logger.Info("Downloaded", "file", "clashofclans-15.0.1.apk")
+	if got := console.String(); strings.Contains(got, "hidden") || !strings.Contains(got, "file=clashofclans-15.0.1.apk") {
+		t.Errorf("text output = %q", got)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counters and gauges about checks, downloads and decompression, served in the Prometheus text format.
+// A nil *Metrics records nothing, so the pipeline can call it unconditionally
+type Metrics struct {
+	mu       sync.Mutex
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+// Result label values
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+const (
+	metricChecks          = "apk_updater_checks_total"
+	metricNewVersions     = "apk_updater_new_versions_total"
+	metricDownloads       = "apk_updater_downloads_total"
+	metricDownloadBytes   = "apk_updater_download_bytes_total"
+	metricDownloadSeconds = "apk_updater_download_duration_seconds_total"
+	metricAssets          = "apk_updater_decompressed_assets_total"
+	metricLastSeen        = "apk_updater_last_seen_version_timestamp_seconds"
+)
+
+type metricFamily struct {
+	name, help, kind string
+	labels           []string
+	values           map[string]float64 // keyed by the rendered label set
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{byName: make(map[string]*metricFamily)}
+	m.add(metricChecks, "counter", "Version checks by game and result", "game", "result")
+	m.add(metricNewVersions, "counter", "New versions found by game", "game")
+	m.add(metricDownloads, "counter", "APK downloads by game and result", "game", "result")
+	m.add(metricDownloadBytes, "counter", "Bytes of APKs downloaded by game", "game")
+	m.add(metricDownloadSeconds, "counter", "Time spent downloading APKs by game", "game")
+	m.add(metricAssets, "counter", "Decompressed assets by compression format and status", "format", "status")
+	m.add(metricLastSeen, "gauge", "Unix time the current version of a game was first seen", "game", "version")
+	return m
+}
+
+func (m *Metrics) add(name, kind, help string, labels ...string) {
+	family := &metricFamily{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	m.families = append(m.families, family)
+	m.byName[name] = family
+}
+
+// Adds delta to the series of name with the label values given in the family's order
+func (m *Metrics) inc(name string, delta float64, values ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family := m.byName[name]
+	family.values[family.key(values)] += delta
+}
+
+func (f *metricFamily) key(values []string) string {
+	pairs := make([]string, len(f.labels))
+	for i, label := range f.labels {
+		pairs[i] = label + `="` + escapeLabel(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+// Counts a version check of game
+func (m *Metrics) CheckDone(game string, err error) {
+	m.inc(metricChecks, 1, game, result(err))
+}
+
+// Counts a new version of game
+func (m *Metrics) NewVersion(game string) {
+	m.inc(metricNewVersions, 1, game)
+}
+
+// Counts a download of game, bytes is how much was received even if it failed
+func (m *Metrics) DownloadDone(game string, bytes int64, took time.Duration, err error) {
+	m.inc(metricDownloads, 1, game, result(err))
+	m.inc(metricDownloadBytes, float64(bytes), game)
+	m.inc(metricDownloadSeconds, took.Seconds(), game)
+}
+
+// Counts a decompressed asset, status is AssetDecompressed or AssetFailed
+func (m *Metrics) AssetDone(format, status string) {
+	m.inc(metricAssets, 1, format, status)
+}
+
+// Sets when the current version of game was first seen, replacing the series of its previous version
+func (m *Metrics) VersionSeen(game, version string, at time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family := m.byName[metricLastSeen]
+	prefix := `{game="` + escapeLabel(game) + `",`
+	for key := range family.values {
+		if strings.HasPrefix(key, prefix) {
+			delete(family.values, key)
+		}
+	}
+	family.values[family.key([]string{game, version})] = float64(at.Unix())
+}
+
+// Writes every metric in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	for _, family := range m.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		keys := make([]string, 0, len(family.values))
+		for key := range family.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s%s %s\n", family.name, key, strconv.FormatFloat(family.values[key], 'g', -1, 64))
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Serves the metrics, meant to be mounted on /metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+// Zstandard frames start with this
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// The compression format of an asset, read from the same header sc-compression looks at:
+// lzma, sc, sclz (LZHAM), zstd, sig or none
+func assetFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, zstdMagic):
+		return "zstd"
+	case len(header) >= 3 && header[0] == 0x5d && header[1] == 0 && header[2] == 0:
+		return "lzma"
+	case len(header) >= 2 && strings.EqualFold(string(header[:2]), "sc"):
+		if len(header) >= 30 && strings.EqualFold(string(header[26:30]), "sclz") {
+			return "sclz"
+		}
+		if len(header) >= 30 && bytes.Equal(header[26:30], zstdMagic) {
+			return "zstd"
+		}
+		return "sc"
+	case len(header) >= 4 && strings.EqualFold(string(header[:4]), "sig:"):
+		return "sig"
+	default:
+		return "none"
+	}
+}
@@ -0,0 +1,118 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+	m.CheckDone("Clash of Clans", nil)
+	m.CheckDone("Clash of Clans", errors.New("boom"))
+	m.DownloadDone("Clash of Clans", 2048, 1500*time.Millisecond, nil)
+	m.DownloadDone("Clash of Clans", 10, time.Second, errors.New("reset"))
+	m.AssetDone("sclz", AssetDecompressed)
+	m.AssetDone("sclz", AssetDecompressed)
+	m.AssetDone("lzma", AssetFailed)
+	m.VersionSeen(`Say "hi"`, "1.0.0", time.Unix(100, 0))
+	m.VersionSeen(`Say "hi"`, "1.1.0", time.Unix(200, 0))
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE apk_updater_checks_total counter\n",
+		`apk_updater_checks_total{game="Clash of Clans",result="success"} 1` + "\n",
+		`apk_updater_checks_total{game="Clash of Clans",result="failure"} 1` + "\n",
+		`apk_updater_downloads_total{game="Clash of Clans",result="failure"} 1` + "\n",
+		`apk_updater_download_bytes_total{game="Clash of Clans"} 2058` + "\n",
+		`apk_updater_download_duration_seconds_total{game="Clash of Clans"} 2.5` + "\n",
+		`apk_updater_decompressed_assets_total{format="sclz",status="decompressed"} 2` + "\n",
+		`apk_updater_decompressed_assets_total{format="lzma",status="failed"} 1` + "\n",
+		"# TYPE apk_updater_last_seen_version_timestamp_seconds gauge\n",
+		`apk_updater_last_seen_version_timestamp_seconds{game="Say \"hi\"",version="1.1.0"} 200` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics are missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "apk_updater_download_failures_total") {
+		t.Errorf("failed downloads are already counted by apk_updater_downloads_total:\n%s", body)
+	}
+	if strings.Contains(body, `version="1.0.0"`) {
+		t.Errorf("the previous version's gauge wasn't replaced:\n%s", body)
+	}
+
+	// Nil metrics are a no-op
+	var none *Metrics
+	none.CheckDone("Clash of Clans", nil)
+}
+
+func TestAssetFormat(t *testing.T) {
+	sclz := []byte("SC" + strings.Repeat("\x00", 24) + "SCLZ!")
+	tests := map[string][]byte{
+		"lzma": {0x5d, 0, 0, 4, 0},
+		"sc":   []byte("SC\x00\x00\x00\x01"),
+		"sclz": sclz,
+		"sig":  []byte("Sig:abcdef"),
+		"none": []byte("name,id\n"),
+	}
+	for want, header := range tests {
+		if got := assetFormat(header); got != want {
+			t.Errorf("assetFormat(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestWatcherMetrics(t *testing.T) {
+	srv, _ := newFakeVersionsServer(t, 1, 2)
+	state, _ := LoadWatchState(filepath.Join(t.TempDir(), "state.json"))
+	metrics := NewMetrics()
+	w := &Watcher{
+		Updater: New(WithSource(testSource(srv.URL)), WithOutputRoot(t.TempDir()), WithMetrics(metrics), WithProgress(NoProgress{})),
+		Games:   []*GameLink{&ClashofClans},
+		State:   state,
+	}
+	w.CheckAll(context.Background())
+	_ = state.Set(ClashofClans.Name, "1.1.0")
+	w.CheckAll(context.Background()) // the fake APK can't be decompiled
+
+	var out strings.Builder
+	_, _ = metrics.WriteTo(&out)
+	for _, want := range []string{
+		`apk_updater_checks_total{game="Clash of Clans",result="success"} 1`,
+		`apk_updater_checks_total{game="Clash of Clans",result="failure"} 1`,
+		`apk_updater_downloads_total{game="Clash of Clans",result="success"} 1`,
+		`apk_updater_last_seen_version_timestamp_seconds{game="Clash of Clans",version="1.2.0"}`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics are missing %q:\n%s", want, out.String())
+		}
+	}
+	if state.SeenAt(ClashofClans.Name).IsZero() {
+		t.Error("SeenAt() is zero after Set()")
+	}
+}
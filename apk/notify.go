@@ -0,0 +1,321 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// What changed between two decompressed asset trees, paths are slash separated and relative to the tree
+type AssetChanges struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+func (c *AssetChanges) Empty() bool {
+	return c == nil || len(c.Added)+len(c.Removed)+len(c.Modified) == 0
+}
+
+// e.g. "2 added, 0 removed, 14 modified"
+func (c *AssetChanges) Summary() string {
+	if c == nil {
+		return "no asset comparison available"
+	}
+	return fmt.Sprintf("%d added, %d removed, %d modified", len(c.Added), len(c.Removed), len(c.Modified))
+}
+
+// Compares two asset trees by content
+func DiffAssetTrees(oldDir, newDir string) (*AssetChanges, error) {
+	oldFiles, err := hashTree(oldDir)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := hashTree(newDir)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &AssetChanges{Added: []string{}, Removed: []string{}, Modified: []string{}}
+	for path, sum := range newFiles {
+		oldSum, ok := oldFiles[path]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, path)
+		case oldSum != sum:
+			changes.Modified = append(changes.Modified, path)
+		}
+	}
+	for path := range oldFiles {
+		if _, ok := newFiles[path]; !ok {
+			changes.Removed = append(changes.Removed, path)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Modified)
+	return changes, nil
+}
+
+func hashTree(root string) (map[string][sha256.Size]byte, error) {
+	sums := make(map[string][sha256.Size]byte)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		sums[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	return sums, err
+}
+
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	fd, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, fd); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// Sent when a watched game gets a new version
+type Notification struct {
+	Game        string        `json:"game"`
+	OldVersion  string        `json:"old_version"`
+	NewVersion  string        `json:"new_version"`
+	ReleaseDate string        `json:"release_date"`
+	Changes     *AssetChanges `json:"changes"` // nil when there was no previous version to compare against
+}
+
+func (n *Notification) title() string {
+	if n.OldVersion == "" {
+		return fmt.Sprintf("%s %s is out", n.Game, n.NewVersion)
+	}
+	return fmt.Sprintf("%s updated from %s to %s", n.Game, n.OldVersion, n.NewVersion)
+}
+
+// The changed files as a short list, at most max entries and maxLen bytes including the "... and N more" line
+func (n *Notification) changeList(max, maxLen int) string {
+	if n.Changes.Empty() {
+		return ""
+	}
+	var lines []string
+	add := func(prefix string, paths []string) {
+		for _, p := range paths {
+			lines = append(lines, prefix+" "+p)
+		}
+	}
+	add("+", n.Changes.Added)
+	add("-", n.Changes.Removed)
+	add("~", n.Changes.Modified)
+
+	more := func(n int) string { return fmt.Sprintf("... and %d more", n) }
+	var list strings.Builder
+	listed := 0
+	for i, line := range lines {
+		if listed == max {
+			break
+		}
+		length := list.Len() + len(line)
+		if list.Len() > 0 {
+			length++
+		}
+		if rest := len(lines) - i - 1; rest > 0 {
+			length += 1 + len(more(rest)) // keep room to say what didn't fit
+		}
+		if length > maxLen {
+			break
+		}
+		if list.Len() > 0 {
+			list.WriteByte('\n')
+		}
+		list.WriteString(line)
+		listed++
+	}
+	if listed < len(lines) {
+		if list.Len() > 0 {
+			list.WriteByte('\n')
+		}
+		list.WriteString(more(len(lines) - listed))
+	}
+	return list.String()
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// The payload shape a webhook expects
+type WebhookFormat string
+
+const (
+	WebhookJSON    WebhookFormat = "json"
+	WebhookDiscord WebhookFormat = "discord"
+	WebhookSlack   WebhookFormat = "slack"
+)
+
+// How many changed files are listed in Discord and Slack messages
+const maxListedChanges = 20
+
+// Longest text Discord accepts in an embed field and Slack in a section, longer messages are rejected
+const (
+	maxDiscordFieldLen = 1024
+	maxSlackSectionLen = 3000
+)
+
+// Posts notifications to a webhook, failed posts are retried with backoff by the retryablehttp client
+type Webhook struct {
+	URL    string
+	Format WebhookFormat
+	client *retryablehttp.Client
+}
+
+// A nil client gets the same retrying client LoadRetryClient builds
+func NewWebhook(url string, format WebhookFormat, client *retryablehttp.Client) *Webhook {
+	if client == nil {
+		client = LoadRetryClient()
+	}
+	return &Webhook{URL: url, Format: format, client: client}
+}
+
+// Parses "discord=https://...", "slack=https://..." or "json=https://...", a bare URL is a JSON webhook
+func ParseWebhook(spec string, client *retryablehttp.Client) (*Webhook, error) {
+	format, url := WebhookJSON, spec
+	if i := strings.Index(spec, "="); i != -1 && !strings.Contains(spec[:i], "/") {
+		format, url = WebhookFormat(spec[:i]), spec[i+1:]
+	}
+	switch format {
+	case WebhookJSON, WebhookDiscord, WebhookSlack:
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q, expected json, discord or slack", format)
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid webhook URL %q", url)
+	}
+	return NewWebhook(url, format, client), nil
+}
+
+func (w *Webhook) Notify(ctx context.Context, n *Notification) error {
+	body, err := w.payload(n)
+	if err != nil {
+		return err
+	}
+	req, err := retryablehttp.NewRequest("POST", w.URL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s webhook answered %s", w.Format, resp.Status)
+	}
+	return nil
+}
+
+func (w *Webhook) payload(n *Notification) ([]byte, error) {
+	switch w.Format {
+	case WebhookDiscord:
+		fields := []map[string]interface{}{
+			{"name": "Version", "value": n.NewVersion, "inline": true},
+			{"name": "Released", "value": orDash(n.ReleaseDate), "inline": true},
+			{"name": "Assets", "value": n.Changes.Summary()},
+		}
+		if list := n.changeList(maxListedChanges, maxDiscordFieldLen-len("```\n\n```")); list != "" {
+			fields = append(fields, map[string]interface{}{"name": "Changed files", "value": "```\n" + list + "\n```"})
+		}
+		return json.Marshal(map[string]interface{}{
+			"content": n.title(),
+			"embeds": []map[string]interface{}{{
+				"title":  n.Game,
+				"color":  0x2ecc71,
+				"fields": fields,
+			}},
+		})
+	case WebhookSlack:
+		text := fmt.Sprintf("*%s*\nReleased: %s\nAssets: %s", n.title(), orDash(n.ReleaseDate), n.Changes.Summary())
+		if list := n.changeList(maxListedChanges, maxSlackSectionLen-len(text)-len("\n``````")); list != "" {
+			text += "\n```" + list + "```"
+		}
+		return json.Marshal(map[string]interface{}{
+			"text": n.title(),
+			"blocks": []map[string]interface{}{{
+				"type": "section",
+				"text": map[string]string{"type": "mrkdwn", "text": text},
+			}},
+		})
+	default:
+		return json.Marshal(struct {
+			Event string `json:"event"`
+			*Notification
+		}{Event: "new_version", Notification: n})
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Sends every notification to each notifier, one failing doesn't stop the others
+type MultiNotifier []Notifier
+
+func (m MultiNotifier) Notify(ctx context.Context, n *Notification) error {
+	var errs []string
+	for _, notifier := range m {
+		if err := notifier.Notify(ctx, n); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Records every body posted to it, answering with the queued status codes first
+type webhookReceiver struct {
+	mu       sync.Mutex
+	bodies   []map[string]interface{}
+	statuses []int
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if len(rcv.statuses) > 0 {
+		status := rcv.statuses[0]
+		rcv.statuses = rcv.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	var body map[string]interface{}
+	data, _ := io.ReadAll(r.Body)
+	_ = json.Unmarshal(data, &body)
+	rcv.bodies = append(rcv.bodies, body)
+}
+
+func fastRetryClient() *retryablehttp.Client {
+	client := LoadRetryClient()
+	client.RetryWaitMin = time.Millisecond
+	client.RetryWaitMax = 5 * time.Millisecond
+	return client
+}
+
+var testNotification = &Notification{
+	Game:        "Clash of Clans",
+	OldVersion:  "15.83.24",
+	NewVersion:  "15.90.1",
+	ReleaseDate: "Jan 2, 2024",
+	Changes:     &AssetChanges{Added: []string{"csv/new.csv"}, Removed: []string{}, Modified: []string{"logic/buildings.csv"}},
+}
+
+func TestWebhookFormats(t *testing.T) {
+	tests := []struct {
+		format WebhookFormat
+		check  func(t *testing.T, body map[string]interface{})
+	}{
+		{format: WebhookJSON, check: func(t *testing.T, body map[string]interface{}) {
+			if body["event"] != "new_version" || body["game"] != "Clash of Clans" || body["old_version"] != "15.83.24" || body["new_version"] != "15.90.1" {
+				t.Errorf("unexpected JSON payload %v", body)
+			}
+			changes, _ := body["changes"].(map[string]interface{})
+			if !reflect.DeepEqual(changes["added"], []interface{}{"csv/new.csv"}) {
+				t.Errorf("JSON payload changes = %v", changes)
+			}
+		}},
+		{format: WebhookDiscord, check: func(t *testing.T, body map[string]interface{}) {
+			if !strings.Contains(body["content"].(string), "15.83.24 to 15.90.1") {
+				t.Errorf("Discord content = %v", body["content"])
+			}
+			embeds := body["embeds"].([]interface{})
+			fields, _ := json.Marshal(embeds[0].(map[string]interface{})["fields"])
+			for _, want := range []string{"Jan 2, 2024", "1 added, 0 removed, 1 modified", "~ logic/buildings.csv"} {
+				if !strings.Contains(string(fields), want) {
+					t.Errorf("Discord fields %s are missing %q", fields, want)
+				}
+			}
+		}},
+		{format: WebhookSlack, check: func(t *testing.T, body map[string]interface{}) {
+			blocks, _ := json.Marshal(body["blocks"])
+			for _, want := range []string{"Clash of Clans updated", "Jan 2, 2024", "+ csv/new.csv"} {
+				if !strings.Contains(string(blocks), want) {
+					t.Errorf("Slack blocks %s are missing %q", blocks, want)
+				}
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			rcv := &webhookReceiver{}
+			srv := httptest.NewServer(rcv)
+			defer srv.Close()
+
+			if err := NewWebhook(srv.URL, tt.format, fastRetryClient()).Notify(context.Background(), testNotification); err != nil {
+				t.Fatalf("Notify() error = %v", err)
+			}
+			if len(rcv.bodies) != 1 {
+				t.Fatalf("receiver got %d posts, want 1", len(rcv.bodies))
+			}
+			tt.check(t, rcv.bodies[0])
+		})
+	}
+}
+
+func TestWebhookLongChangeList(t *testing.T) {
+	n := *testNotification
+	n.Changes = &AssetChanges{Added: []string{}, Removed: []string{}}
+	for i := 0; i < 50; i++ {
+		n.Changes.Modified = append(n.Changes.Modified, fmt.Sprintf("localization/%s/texts_%02d.csv", strings.Repeat("long_folder_name_", 10), i))
+	}
+
+	tests := []struct {
+		format WebhookFormat
+		text   func(body map[string]interface{}) string
+		max    int
+	}{
+		{format: WebhookDiscord, max: maxDiscordFieldLen, text: func(body map[string]interface{}) string {
+			fields := body["embeds"].([]interface{})[0].(map[string]interface{})["fields"].([]interface{})
+			return fields[len(fields)-1].(map[string]interface{})["value"].(string)
+		}},
+		{format: WebhookSlack, max: maxSlackSectionLen, text: func(body map[string]interface{}) string {
+			block := body["blocks"].([]interface{})[0].(map[string]interface{})
+			return block["text"].(map[string]interface{})["text"].(string)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			rcv := &webhookReceiver{}
+			srv := httptest.NewServer(rcv)
+			defer srv.Close()
+
+			if err := NewWebhook(srv.URL, tt.format, fastRetryClient()).Notify(context.Background(), &n); err != nil {
+				t.Fatalf("Notify() error = %v", err)
+			}
+			text := tt.text(rcv.bodies[0])
+			if len(text) > tt.max {
+				t.Errorf("%s text is %d bytes, over the %d limit", tt.format, len(text), tt.max)
+			}
+			listed := strings.Count(text, "~ localization/")
+			if listed == 0 || !strings.Contains(text, fmt.Sprintf("... and %d more", 50-listed)) {
+				t.Errorf("%s text lists %d files without saying how many more there are:\n%s", tt.format, listed, text)
+			}
+		})
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	rcv := &webhookReceiver{statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	if err := NewWebhook(srv.URL, WebhookJSON, fastRetryClient()).Notify(context.Background(), testNotification); err != nil {
+		t.Fatalf("Notify() should succeed after retrying, error = %v", err)
+	}
+	if len(rcv.bodies) != 1 {
+		t.Errorf("receiver got %d successful posts, want 1", len(rcv.bodies))
+	}
+
+	rcv.statuses = []int{http.StatusBadRequest}
+	if err := NewWebhook(srv.URL, WebhookJSON, fastRetryClient()).Notify(context.Background(), testNotification); err == nil {
+		t.Error("Notify() should fail on a 400")
+	}
+}
+
+func TestParseWebhook(t *testing.T) {
+	tests := []struct {
+		spec    string
+		format  WebhookFormat
+		url     string
+		wantErr bool
+	}{
+		{spec: "https://example.com/hook", format: WebhookJSON, url: "https://example.com/hook"},
+		{spec: "discord=https://discord.com/api/webhooks/1/a", format: WebhookDiscord, url: "https://discord.com/api/webhooks/1/a"},
+		{spec: "slack=https://hooks.slack.com/services/x", format: WebhookSlack, url: "https://hooks.slack.com/services/x"},
+		{spec: "https://example.com/hook?a=b", format: WebhookJSON, url: "https://example.com/hook?a=b"},
+		{spec: "teams=https://example.com", wantErr: true},
+		{spec: "discord=not-a-url", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			w, err := ParseWebhook(tt.spec, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (w.Format != tt.format || w.URL != tt.url) {
+				t.Errorf("ParseWebhook() = %s %s, want %s %s", w.Format, w.URL, tt.format, tt.url)
+			}
+		})
+	}
+}
+
+func TestDiffAssetTrees(t *testing.T) {
+	root := t.TempDir()
+	write := func(path, content string) {
+		t.Helper()
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("old/csv/same.csv", "a")
+	write("old/csv/changed.csv", "b")
+	write("old/logic/gone.csv", "c")
+	write("new/csv/same.csv", "a")
+	write("new/csv/changed.csv", "B")
+	write("new/csv/new.csv", "d")
+
+	changes, err := DiffAssetTrees(filepath.Join(root, "old"), filepath.Join(root, "new"))
+	if err != nil {
+		t.Fatalf("DiffAssetTrees() error = %v", err)
+	}
+	want := &AssetChanges{Added: []string{"csv/new.csv"}, Removed: []string{"logic/gone.csv"}, Modified: []string{"csv/changed.csv"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("DiffAssetTrees() = %+v, want %+v", changes, want)
+	}
+}
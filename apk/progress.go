@@ -0,0 +1,356 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// What a task counts
+type ProgressUnit string
+
+const (
+	Bytes ProgressUnit = "bytes"
+	Items ProgressUnit = "items"
+)
+
+// Reports how far long running work (downloads, decompressing assets) has come
+type Progress interface {
+	// Starts a task, total is how many bytes or items it will take, 0 or less when unknown
+	Start(name string, unit ProgressUnit, total int64) ProgressTask
+}
+
+type ProgressTask interface {
+	// n more bytes or items are done, item names what was just done and may be empty
+	Advance(n int64, item string)
+	// The task is over, err is nil if it succeeded
+	Finish(err error)
+}
+
+// Progress renderers that can be picked by name, auto is tty on a terminal and plain otherwise
+const (
+	ProgressAuto  = "auto"
+	ProgressTTY   = "tty"
+	ProgressPlain = "plain"
+	ProgressJSON  = "json"
+	ProgressNone  = "none"
+)
+
+// Builds the renderer named mode writing to f
+func NewProgress(mode string, f *os.File) (Progress, error) {
+	switch mode {
+	case ProgressAuto, "":
+		if term.IsTerminal(int(f.Fd())) {
+			return NewTTYProgress(f), nil
+		}
+		return NewPlainProgress(f), nil
+	case ProgressTTY:
+		return NewTTYProgress(f), nil
+	case ProgressPlain:
+		return NewPlainProgress(f), nil
+	case ProgressJSON:
+		return NewJSONProgress(f), nil
+	case ProgressNone:
+		return NoProgress{}, nil
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q, expected auto, tty, plain, json or none", mode)
+	}
+}
+
+// Reports nothing
+type NoProgress struct{}
+
+func (NoProgress) Start(string, ProgressUnit, int64) ProgressTask { return noTask{} }
+
+type noTask struct{}
+
+func (noTask) Advance(int64, string) {}
+func (noTask) Finish(error)          {}
+
+// The counters every renderer keeps per task
+type taskState struct {
+	name  string
+	unit  ProgressUnit
+	total int64
+	done  int64
+	item  string
+	start time.Time
+	last  time.Time // when the task was last rendered
+}
+
+func (t *taskState) advance(n int64, item string) {
+	t.done += n
+	if item != "" {
+		t.item = item
+	}
+}
+
+func (t *taskState) percent() float64 {
+	if t.total <= 0 {
+		return 0
+	}
+	return float64(t.done) / float64(t.total) * 100
+}
+
+// Throughput in units per second
+func (t *taskState) rate() float64 {
+	elapsed := time.Since(t.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(t.done) / elapsed
+}
+
+// e.g. "45.2% 12.3 MB of 27.1 MB, 3.20 MB/s" or "12/40 items"
+func (t *taskState) counts() string {
+	if t.unit == Bytes {
+		s := formatBytes(t.done)
+		if t.total > 0 {
+			s = fmt.Sprintf("%.1f%% %s of %s", t.percent(), s, formatBytes(t.total))
+		}
+		return fmt.Sprintf("%s, %s/s", s, formatBytes(int64(t.rate())))
+	}
+	if t.total > 0 {
+		return fmt.Sprintf("%d/%d", t.done, t.total)
+	}
+	return fmt.Sprintf("%d", t.done)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.2f GB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.2f MB", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.2f kB", float64(n)/1e3)
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// How often a byte counting task is redrawn
+const progressRedraw = 100 * time.Millisecond
+
+// Draws a bar on a single terminal line that is rewritten in place
+type TTYProgress struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewTTYProgress(f *os.File) *TTYProgress {
+	return &TTYProgress{f: f}
+}
+
+func (p *TTYProgress) Start(name string, unit ProgressUnit, total int64) ProgressTask {
+	return &ttyTask{p: p, state: taskState{name: name, unit: unit, total: total, start: time.Now()}}
+}
+
+type ttyTask struct {
+	p     *TTYProgress
+	state taskState
+}
+
+func (t *ttyTask) Advance(n int64, item string) {
+	t.p.mu.Lock()
+	defer t.p.mu.Unlock()
+	t.state.advance(n, item)
+	if t.state.unit == Bytes && time.Since(t.state.last) < progressRedraw {
+		return
+	}
+	t.state.last = time.Now()
+	t.p.draw(&t.state)
+}
+
+func (t *ttyTask) Finish(err error) {
+	t.p.mu.Lock()
+	defer t.p.mu.Unlock()
+	t.p.draw(&t.state)
+	status := fmt.Sprintf("done in %.2fs", time.Since(t.state.start).Seconds())
+	if err != nil {
+		status = "failed: " + err.Error()
+	}
+	fmt.Fprintf(t.p.f, " %s\n", status)
+}
+
+func (p *TTYProgress) draw(t *taskState) {
+	width := 80
+	if w, _, err := term.GetSize(int(p.f.Fd())); err == nil && w > 0 {
+		width = w
+	}
+
+	line := t.name + " "
+	if t.total > 0 {
+		const barWidth = 30
+		filled := int(t.percent() / 100 * barWidth)
+		if filled > barWidth {
+			filled = barWidth
+		}
+		line += "[" + strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled) + "] "
+	}
+	line += t.counts()
+	if t.unit == Items && t.item != "" {
+		line += " " + t.item
+	}
+	if len(line) > width-1 {
+		line = line[:width-1]
+	}
+	fmt.Fprintf(p.f, "\033[2K\r%s", line)
+}
+
+// Writes a line per update, at most one every interval per task plus one when it finishes. Meant for CI logs
+type PlainProgress struct {
+	mu       sync.Mutex
+	w        io.Writer
+	interval time.Duration
+}
+
+// How often PlainProgress writes a line for a task
+const PlainProgressInterval = 5 * time.Second
+
+func NewPlainProgress(w io.Writer) *PlainProgress {
+	return &PlainProgress{w: w, interval: PlainProgressInterval}
+}
+
+func (p *PlainProgress) Start(name string, unit ProgressUnit, total int64) ProgressTask {
+	now := time.Now()
+	p.mu.Lock()
+	fmt.Fprintf(p.w, "%s: started\n", name)
+	p.mu.Unlock()
+	return &plainTask{p: p, state: taskState{name: name, unit: unit, total: total, start: now, last: now}}
+}
+
+type plainTask struct {
+	p     *PlainProgress
+	state taskState
+}
+
+func (t *plainTask) Advance(n int64, item string) {
+	t.p.mu.Lock()
+	defer t.p.mu.Unlock()
+	t.state.advance(n, item)
+	if time.Since(t.state.last) < t.p.interval {
+		return
+	}
+	t.state.last = time.Now()
+	fmt.Fprintf(t.p.w, "%s: %s\n", t.state.name, t.state.counts())
+}
+
+func (t *plainTask) Finish(err error) {
+	t.p.mu.Lock()
+	defer t.p.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(t.p.w, "%s: failed after %s: %s\n", t.state.name, t.state.counts(), err)
+		return
+	}
+	fmt.Fprintf(t.p.w, "%s: done in %.2fs, %s\n", t.state.name, time.Since(t.state.start).Seconds(), t.state.counts())
+}
+
+// Writes newline delimited JSON events, see ProgressEvent. It's also an EventSink,
+// so pipeline events and progress can share a single stream
+type JSONProgress struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// One line of JSONProgress output
+type ProgressEvent struct {
+	Event string       `json:"event"` // start, progress or finish
+	Task  string       `json:"task"`
+	Unit  ProgressUnit `json:"unit"`
+	Done  int64        `json:"done"`
+	Total int64        `json:"total,omitempty"`
+	Item  string       `json:"item,omitempty"`
+	Rate  float64      `json:"rate,omitempty"` // units per second
+	Error string       `json:"error,omitempty"`
+	Time  time.Time    `json:"time"`
+}
+
+func NewJSONProgress(w io.Writer) *JSONProgress {
+	return &JSONProgress{enc: json.NewEncoder(w)}
+}
+
+func (p *JSONProgress) Start(name string, unit ProgressUnit, total int64) ProgressTask {
+	t := &jsonTask{p: p, state: taskState{name: name, unit: unit, total: total, start: time.Now()}}
+	p.emit(t.event("start"))
+	return t
+}
+
+func (p *JSONProgress) emit(e ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.enc.Encode(e)
+}
+
+func (p *JSONProgress) Emit(e Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.enc.Encode(e)
+}
+
+type jsonTask struct {
+	p     *JSONProgress
+	mu    sync.Mutex
+	state taskState
+}
+
+func (t *jsonTask) event(name string) ProgressEvent {
+	return ProgressEvent{
+		Event: name,
+		Task:  t.state.name,
+		Unit:  t.state.unit,
+		Done:  t.state.done,
+		Total: t.state.total,
+		Item:  t.state.item,
+		Rate:  t.state.rate(),
+		Time:  time.Now(),
+	}
+}
+
+// Byte counts are throttled, every item gets its own event
+func (t *jsonTask) Advance(n int64, item string) {
+	t.mu.Lock()
+	t.state.advance(n, item)
+	if t.state.unit == Bytes && time.Since(t.state.last) < progressRedraw {
+		t.mu.Unlock()
+		return
+	}
+	t.state.last = time.Now()
+	e := t.event("progress")
+	t.mu.Unlock()
+	t.p.emit(e)
+}
+
+func (t *jsonTask) Finish(err error) {
+	t.mu.Lock()
+	e := t.event("finish")
+	t.mu.Unlock()
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.p.emit(e)
+}
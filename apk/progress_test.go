@@ -0,0 +1,136 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskStateRate(t *testing.T) {
+	// 5 MB in 2 seconds is 2.5 MB/s
+	state := taskState{unit: Bytes, total: 10e6, done: 5e6, start: time.Now().Add(-2 * time.Second)}
+	if rate := state.rate(); rate < 2.4e6 || rate > 2.5e6 {
+		t.Errorf("rate() = %.0f, want about 2.5e6", rate)
+	}
+	if got := state.counts(); !strings.HasPrefix(got, "50.0% 5.00 MB of 10.00 MB, 2.") || !strings.HasSuffix(got, " MB/s") {
+		t.Errorf("counts() = %q", got)
+	}
+
+	items := taskState{unit: Items, total: 40, done: 12}
+	if got := items.counts(); got != "12/40" {
+		t.Errorf("counts() = %q, want 12/40", got)
+	}
+}
+
+func TestPlainProgress(t *testing.T) {
+	var out bytes.Buffer
+	p := NewPlainProgress(&out)
+	p.interval = 0
+
+	task := p.Start("Decompressing", Items, 2)
+	task.Advance(1, "csv/a.csv")
+	task.Advance(1, "csv/b.csv")
+	task.Finish(nil)
+	failed := p.Start("Downloading", Bytes, 0)
+	failed.Finish(errors.New("boom"))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("got %d lines, want 6:\n%s", len(lines), out.String())
+	}
+	if lines[0] != "Decompressing: started" || lines[2] != "Decompressing: 2/2" || !strings.HasPrefix(lines[3], "Decompressing: done in ") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+	if !strings.Contains(lines[5], "failed") || !strings.HasSuffix(lines[5], ": boom") {
+		t.Errorf("failure line = %q", lines[5])
+	}
+	if strings.Contains(out.String(), "\033") {
+		t.Error("plain progress shouldn't contain escape sequences")
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	var out bytes.Buffer
+	p := NewJSONProgress(&out)
+	task := p.Start("Decompressing", Items, 2)
+	task.Advance(1, "csv/a.csv")
+	task.Advance(1, "csv/b.csv")
+	task.Finish(errors.New("boom"))
+
+	var events []ProgressEvent
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var e ProgressEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 4 {
+		t.Fatalf("got %d events, want 4", len(events))
+	}
+	if events[0].Event != "start" || events[1].Item != "csv/a.csv" || events[2].Done != 2 || events[3].Event != "finish" || events[3].Error != "boom" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+func TestTTYProgress(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "tty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	task := NewTTYProgress(f).Start("Decompressing", Items, 4)
+	task.Advance(2, "csv/a.csv")
+	task.Finish(nil)
+
+	out, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "\033[2K\rDecompressing [===============               ] 2/4 csv/a.csv") || !strings.HasSuffix(string(out), "\n") {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestNewProgress(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if p, err := NewProgress(ProgressAuto, f); err != nil {
+		t.Error(err)
+	} else if _, ok := p.(*PlainProgress); !ok {
+		t.Errorf("auto on a regular file = %T, want *PlainProgress", p)
+	}
+	if _, err = NewProgress("fancy", f); err == nil {
+		t.Error("an unknown mode should fail")
+	}
+}
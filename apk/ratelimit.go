@@ -0,0 +1,64 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Spaces out calls so at most one goes through per interval, shared between goroutines
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func NewRateLimiter(interval time.Duration) *RateLimiter {
+	return &RateLimiter{interval: interval}
+}
+
+// Blocks until the caller's turn comes up or ctx is done
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	if rl == nil || rl.interval <= 0 {
+		return ctx.Err()
+	}
+
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	wait := rl.next.Sub(now)
+	rl.next = rl.next.Add(rl.interval)
+	rl.mu.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,260 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by ReplayTransport for a request that isn't in the recording
+var ErrNotRecorded = errors.New("no recorded response")
+
+// An http.RoundTripper that saves every exchange to Dir so a session can be replayed with ReplayTransport.
+// Each response is numbered in the order it arrived and stored as NNNNN.json (request and headers) and NNNNN.body,
+// the body is written as it's read so big downloads aren't buffered. Cookies and other credential headers are left
+// out so a recording can be attached to a bug report, the URLs are kept as they are
+type RecordTransport struct {
+	Dir  string
+	Next http.RoundTripper
+
+	once sync.Once
+	mu   sync.Mutex
+	seq  int
+	err  error
+}
+
+// One recorded exchange, the .json half
+type recordedExchange struct {
+	Seq        int         `json:"seq"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header"`
+	RecordedAt time.Time   `json:"recorded_at"`
+}
+
+func (r *RecordTransport) next() http.RoundTripper {
+	if r.Next != nil {
+		return r.Next
+	}
+	return http.DefaultTransport
+}
+
+// Creates Dir and continues numbering after what's already in it, so several runs can go into one recording
+func (r *RecordTransport) init() {
+	if r.err = os.MkdirAll(r.Dir, 0755); r.err != nil {
+		return
+	}
+	exchanges, err := loadExchanges(r.Dir)
+	if err != nil {
+		r.err = err
+		return
+	}
+	if len(exchanges) > 0 {
+		r.seq = exchanges[len(exchanges)-1].Seq
+	}
+}
+
+func (r *RecordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.once.Do(r.init)
+	if r.err != nil {
+		return nil, fmt.Errorf("couldn't record to %s: %w", r.Dir, r.err)
+	}
+
+	resp, err := r.next().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.seq++
+	exchange := &recordedExchange{
+		Seq:        r.seq,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Status:     resp.StatusCode,
+		Header:     withoutCredentials(resp.Header),
+		RecordedAt: time.Now(),
+	}
+	r.mu.Unlock()
+
+	base := filepath.Join(r.Dir, fmt.Sprintf("%05d", exchange.Seq))
+	body, err := os.Create(base + ".body")
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("couldn't record %s: %w", exchange.URL, err)
+	}
+	meta, err := json.MarshalIndent(exchange, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(base+".json", meta)
+	}
+	if err != nil {
+		body.Close()
+		resp.Body.Close()
+		return nil, fmt.Errorf("couldn't record %s: %w", exchange.URL, err)
+	}
+	resp.Body = &recordingBody{ReadCloser: resp.Body, file: body}
+	return resp, nil
+}
+
+// Headers that can carry a session, never written to a recording
+var credentialHeaders = []string{"Set-Cookie", "Set-Cookie2", "Cookie", "Authorization", "Proxy-Authorization"}
+
+func withoutCredentials(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range credentialHeaders {
+		header.Del(name)
+	}
+	return header
+}
+
+// Copies a response body to its file as the caller reads it, a body that's closed early is recorded cut short
+type recordingBody struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if _, werr := b.file.Write(p[:n]); werr != nil {
+			return n, fmt.Errorf("couldn't record response body: %w", werr)
+		}
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	ferr := b.file.Close()
+	if err := b.ReadCloser.Close(); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// An http.RoundTripper that answers from a recording made by RecordTransport and never touches the network.
+// Responses for the same method and URL are served in the order they were recorded, once they run out the last one repeats.
+// A request that was never recorded fails with ErrNotRecorded
+type ReplayTransport struct {
+	Dir string
+
+	once      sync.Once
+	mu        sync.Mutex
+	exchanges map[string][]*recordedExchange
+	served    map[string]int
+	err       error
+}
+
+func (r *ReplayTransport) init() {
+	exchanges, err := loadExchanges(r.Dir)
+	if err != nil {
+		r.err = err
+		return
+	}
+	if len(exchanges) == 0 {
+		r.err = fmt.Errorf("no recording in %s", r.Dir)
+		return
+	}
+	r.exchanges = make(map[string][]*recordedExchange)
+	r.served = make(map[string]int)
+	for _, exchange := range exchanges {
+		key := exchange.Method + " " + exchange.URL
+		r.exchanges[key] = append(r.exchanges[key], exchange)
+	}
+}
+
+func (r *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	r.once.Do(r.init)
+	if r.err != nil {
+		return nil, fmt.Errorf("couldn't replay from %s: %w", r.Dir, r.err)
+	}
+
+	key := req.Method + " " + req.URL.String()
+	r.mu.Lock()
+	recorded := r.exchanges[key]
+	i := r.served[key]
+	if i < len(recorded)-1 {
+		r.served[key]++
+	}
+	r.mu.Unlock()
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNotRecorded, key)
+	}
+
+	exchange := recorded[i]
+	body, err := os.ReadFile(filepath.Join(r.Dir, fmt.Sprintf("%05d.body", exchange.Seq)))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't replay %s: %w", key, err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", exchange.Status, http.StatusText(exchange.Status)),
+		StatusCode:    exchange.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        exchange.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// Reads every exchange's metadata in dir ordered by sequence number, a missing dir is an empty recording
+func loadExchanges(dir string) ([]*recordedExchange, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var exchanges []*recordedExchange
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if _, err := strconv.Atoi(name); err != nil || name == entry.Name() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var exchange recordedExchange
+		if err := json.Unmarshal(data, &exchange); err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %w", entry.Name(), err)
+		}
+		exchanges = append(exchanges, &exchange)
+	}
+	sort.Slice(exchanges, func(i, j int) bool { return exchanges[i].Seq < exchanges[j].Seq })
+	return exchanges, nil
+}
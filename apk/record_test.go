@@ -0,0 +1,117 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	srv, game := newUptodownServer(t)
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	session := func(cfg HTTPConfig) ([]VersionData, string, []byte) {
+		t.Helper()
+		client, err := NewHTTPClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := New(WithHTTPClient(client), WithProgress(NoProgress{}))
+		vers, err := u.GetVersions(ctx, game.URL, 1)
+		if err != nil {
+			t.Fatalf("GetVersions() error = %v", err)
+		}
+		url, err := u.Resolve(ctx, &vers[0])
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		fp := filepath.Join(t.TempDir(), "test.apk")
+		if _, err := u.WgetAPK(ctx, game, url, vers[0].Version.String(), fp); err != nil {
+			t.Fatalf("WgetAPK() error = %v", err)
+		}
+		data, _ := os.ReadFile(fp)
+		return vers, url, data
+	}
+
+	wantVers, wantURL, wantAPK := session(HTTPConfig{Record: dir})
+	srv.Close()
+
+	vers, url, apk := session(HTTPConfig{Replay: dir})
+	if len(vers) != len(wantVers) || vers[0].Version.String() != wantVers[0].Version.String() {
+		t.Errorf("replayed GetVersions() = %v, want %v", vers, wantVers)
+	}
+	if url != wantURL {
+		t.Errorf("replayed Resolve() = %s, want %s", url, wantURL)
+	}
+	if len(wantAPK) == 0 || !bytes.Equal(apk, wantAPK) {
+		t.Errorf("replayed WgetAPK() wrote %d bytes, want the %d recorded", len(apk), len(wantAPK))
+	}
+
+	// Anything outside the recording fails straight away instead of being retried
+	client, err := NewHTTPClient(HTTPConfig{Replay: dir, Retries: DefaultHTTPRetries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := New(WithHTTPClient(client), WithProgress(NoProgress{}))
+	if _, err := u.GetVersions(ctx, game.URL, 2); !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("GetVersions() of an unrecorded page error = %v, want %v", err, ErrNotRecorded)
+	}
+
+	if _, err := NewHTTPClient(HTTPConfig{Record: dir, Replay: dir}); err == nil {
+		t.Error("NewHTTPClient() should refuse to record and replay at once")
+	}
+}
+
+func TestRecordStripsCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret-session"})
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html></html>"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	client := &http.Client{Transport: &RecordTransport{Dir: dir}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Set-Cookie") == "" {
+		t.Error("the caller should still get the cookie")
+	}
+
+	meta, err := os.ReadFile(filepath.Join(dir, "00001.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(meta, []byte("secret-session")) || !bytes.Contains(meta, []byte("text/html")) {
+		t.Errorf("recorded headers should keep everything but the cookie:\n%s", meta)
+	}
+}
@@ -0,0 +1,399 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Serves a store over HTTP as JSON:
+//
+//	GET  /api/games                                    every game, with how many versions are stored
+//	GET  /api/games/{game}/versions                    stored versions, newest first
+//	POST /api/games/{game}/fetch?version=1.2.3         queues a fetch of a version into the store, the newest without version
+//	GET  /api/games/{game}/versions/{version}/files    the version's manifest
+//	GET  /api/games/{game}/versions/{version}/files/*  a decompressed asset
+//	GET  /api/games/{game}/versions/{version}/csv/*    a CSV asset as a CSVTable
+//	GET  /api/games/{game}/diff?from=1.2.3&to=1.3.0    the files added, removed and modified between two versions
+//	GET  /api/jobs                                     every fetch job, newest first
+//	GET  /api/jobs/{id}                                one job with its logs
+//
+// {game} is a game's name or slug, a fetched version must be in the game's listing. Fetches are run by Jobs, which must be running for them to make progress.
+// With UI set, every other GET is answered with the embedded web UI
+type Server struct {
+	Updater *Updater
+	Jobs    *JobQueue
+	UI      bool
+}
+
+func NewServer(u *Updater, jobs *JobQueue) (*Server, error) {
+	if u.store == nil {
+		return nil, errors.New("the server needs an updater with a store")
+	}
+	return &Server{Updater: u, Jobs: jobs}, nil
+}
+
+// A stored game as listed by /api/games
+type GameInfo struct {
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	Package  string `json:"package,omitempty"`
+	Versions int    `json:"versions"`
+	Latest   string `json:"latest,omitempty"` // newest stored version
+}
+
+// A stored version as listed by /api/games/{game}/versions
+type VersionInfo struct {
+	Version string `json:"version"`
+	Date    string `json:"date,omitempty"`
+	Files   int    `json:"files"`
+}
+
+// What changed between two stored versions, as returned by /api/games/{game}/diff
+type VersionDiff struct {
+	Game    string        `json:"game"`
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Changes *AssetChanges `json:"changes"`
+}
+
+// What POST /api/games/{game}/fetch did
+type FetchStatus struct {
+	Game    string `json:"game"`
+	Version string `json:"version"`
+	Status  string `json:"status"` // stored, queued or coalesced
+	Job     *Job   `json:"job,omitempty"`
+}
+
+// Fetch statuses
+const (
+	FetchStored    = "stored"    // nothing to do
+	FetchQueued    = "queued"    // a new job was queued
+	FetchCoalesced = "coalesced" // a job for the same version was already queued or running
+)
+
+// Errors that map to an HTTP status
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func notFound(format string, args ...any) error {
+	return &httpError{http.StatusNotFound, fmt.Errorf(format, args...)}
+}
+
+func badRequest(format string, args ...any) error {
+	return &httpError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) >= 2 && parts[0] == "api" && parts[1] == "jobs" {
+		s.serveJobs(w, r, parts[2:])
+		return
+	}
+	if len(parts) < 2 || parts[0] != "api" || parts[1] != "games" {
+		if r.URL.Path == "/metrics" && s.Updater.metrics != nil {
+			s.Updater.metrics.ServeHTTP(w, r)
+			return
+		}
+		if s.UI && parts[0] != "api" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			uiHandler.ServeHTTP(w, r)
+			return
+		}
+		writeError(w, notFound("no such endpoint %s", r.URL.Path))
+		return
+	}
+	parts = parts[2:]
+
+	method := http.MethodGet
+	if len(parts) == 2 && parts[1] == "fetch" {
+		method = http.MethodPost
+	}
+	if r.Method != method && !(method == http.MethodGet && r.Method == http.MethodHead) {
+		w.Header().Set("Allow", method)
+		writeError(w, &httpError{http.StatusMethodNotAllowed, fmt.Errorf("%s needs %s", r.URL.Path, method)})
+		return
+	}
+
+	var err error
+	switch {
+	case len(parts) == 0:
+		err = s.listGames(w)
+	case len(parts) == 2 && parts[1] == "versions":
+		err = s.listVersions(w, parts[0])
+	case len(parts) == 2 && parts[1] == "fetch":
+		err = s.fetch(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "diff":
+		err = s.diff(w, parts[0], r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	case len(parts) == 4 && parts[1] == "versions" && parts[3] == "files":
+		err = s.listFiles(w, parts[0], parts[2])
+	case len(parts) > 4 && parts[1] == "versions" && (parts[3] == "files" || parts[3] == "csv"):
+		err = s.serveFile(w, r, parts[0], parts[2], strings.Join(parts[4:], "/"), parts[3] == "csv")
+	default:
+		err = notFound("no such endpoint %s", r.URL.Path)
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var herr *httpError
+	switch {
+	case errors.As(err, &herr):
+		status = herr.status
+	case errors.Is(err, ErrNotStored):
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// The slug of a known game, or of a game that is only in the store
+func (s *Server) gameSlug(name string) (string, *GameLink, error) {
+	if game, ok := FindGame(name); ok {
+		return game.Slug(), game, nil
+	}
+	stored, err := s.Updater.store.Games()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, slug := range stored {
+		if slug == name {
+			return slug, nil, nil
+		}
+	}
+	return "", nil, notFound("unknown game %q", name)
+}
+
+func (s *Server) manifest(game, version string) (*Manifest, error) {
+	slug, _, err := s.gameSlug(game)
+	if err != nil {
+		return nil, err
+	}
+	v, err := ParseVersion(version)
+	if err != nil {
+		return nil, badRequest("invalid version %q", version)
+	}
+	return s.Updater.store.Manifest(slug, v.String())
+}
+
+func (s *Server) listGames(w http.ResponseWriter) error {
+	stored, err := s.Updater.store.Games()
+	if err != nil {
+		return err
+	}
+	games := make([]GameInfo, 0, len(AllGameLinks))
+	seen := make(map[string]bool)
+	for _, game := range AllGameLinks {
+		games = append(games, GameInfo{Name: game.Name, Slug: game.Slug(), Package: game.Package})
+		seen[game.Slug()] = true
+	}
+	for _, slug := range stored {
+		if !seen[slug] {
+			games = append(games, GameInfo{Name: slug, Slug: slug})
+		}
+	}
+	for i := range games {
+		versions, err := s.Updater.store.Versions(games[i].Slug)
+		if err != nil {
+			return err
+		}
+		games[i].Versions = len(versions)
+		if len(versions) > 0 {
+			games[i].Latest = versions[0].String()
+		}
+	}
+	writeJSON(w, http.StatusOK, games)
+	return nil
+}
+
+func (s *Server) listVersions(w http.ResponseWriter, game string) error {
+	slug, _, err := s.gameSlug(game)
+	if err != nil {
+		return err
+	}
+	versions, err := s.Updater.store.Versions(slug)
+	if err != nil {
+		return err
+	}
+	infos := make([]VersionInfo, 0, len(versions))
+	for _, v := range versions {
+		m, err := s.Updater.store.Manifest(slug, v.String())
+		if err != nil {
+			return err
+		}
+		infos = append(infos, VersionInfo{Version: m.Version, Date: m.Date, Files: len(m.Files)})
+	}
+	writeJSON(w, http.StatusOK, infos)
+	return nil
+}
+
+func (s *Server) listFiles(w http.ResponseWriter, game, version string) error {
+	m, err := s.manifest(game, version)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, m)
+	return nil
+}
+
+func (s *Server) diff(w http.ResponseWriter, game, from, to string) error {
+	if from == "" || to == "" {
+		return badRequest("diff needs both from and to")
+	}
+	old, err := s.manifest(game, from)
+	if err != nil {
+		return err
+	}
+	next, err := s.manifest(game, to)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, VersionDiff{Game: next.Game, From: old.Version, To: next.Version, Changes: DiffManifests(old, next)})
+	return nil
+}
+
+// Serves one asset as is, or parsed into a CSVTable
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, game, version, file string, asTable bool) error {
+	m, err := s.manifest(game, version)
+	if err != nil {
+		return err
+	}
+	entry, ok := m.Lookup(file)
+	if !ok {
+		return notFound("%s %s has no file %s", m.Game, m.Version, file)
+	}
+	f, err := s.Updater.store.Open(entry.Hash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !asTable {
+		http.ServeContent(w, r, path.Base(file), time.Time{}, f)
+		return nil
+	}
+	if path.Ext(file) != ".csv" {
+		return badRequest("%s isn't a CSV file", file)
+	}
+	table, err := ParseCSVTable(f)
+	if err != nil {
+		return &httpError{http.StatusUnprocessableEntity, fmt.Errorf("parsing %s: %w", file, err)}
+	}
+	writeJSON(w, http.StatusOK, table)
+	return nil
+}
+
+func (s *Server) serveJobs(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, &httpError{http.StatusMethodNotAllowed, fmt.Errorf("%s needs GET", r.URL.Path)})
+		return
+	}
+	switch len(parts) {
+	case 0:
+		writeJSON(w, http.StatusOK, s.Jobs.Jobs())
+	case 1:
+		job, ok := s.Jobs.Job(parts[0])
+		if !ok {
+			writeError(w, notFound("no job %s", parts[0]))
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	default:
+		writeError(w, notFound("no such endpoint %s", r.URL.Path))
+	}
+}
+
+// Resolves the requested version and queues a fetch of it unless it's already stored
+// Finds version in the game's full listing. Unlike UpdateAPK there's no falling back to the app page,
+// it only ever has the current APK and storing that under another version would corrupt the store's history
+func (s *Server) listedVersion(ctx context.Context, game *GameLink, version Version) (*VersionData, error) {
+	versions, err := s.Updater.Versions(ctx, game)
+	if err != nil {
+		return nil, &httpError{http.StatusBadGateway, err}
+	}
+	exact, err := ParseVersionRange("=" + version.String())
+	if err != nil {
+		return nil, badRequest("invalid version %q", version)
+	}
+	matched := FilterVersions(versions, exact)
+	if len(matched) == 0 {
+		return nil, notFound("%s %s isn't listed", game.Name, version)
+	}
+	return &matched[0], nil
+}
+
+func (s *Server) fetch(w http.ResponseWriter, r *http.Request, name string) error {
+	game, ok := FindGame(name)
+	if !ok {
+		return notFound("unknown game %q", name)
+	}
+
+	var data *VersionData
+	var err error
+	if requested := r.URL.Query().Get("version"); requested != "" {
+		version, err := ParseVersion(requested)
+		if err != nil {
+			return badRequest("invalid version %q", requested)
+		}
+		if data, err = s.listedVersion(r.Context(), game, version); err != nil {
+			return err
+		}
+	} else if data, err = s.Updater.Latest(r.Context(), game); err != nil {
+		return &httpError{http.StatusBadGateway, err}
+	}
+
+	status := FetchStatus{Game: game.Slug(), Version: data.Version.String()}
+	if _, err := s.Updater.store.Manifest(status.Game, status.Version); err == nil {
+		status.Status = FetchStored
+		writeJSON(w, http.StatusOK, status)
+		return nil
+	}
+
+	job, created, err := s.Jobs.Submit(game, *data)
+	if err != nil {
+		return err
+	}
+	status.Status, status.Job = FetchCoalesced, &job
+	if created {
+		status.Status = FetchQueued
+	}
+	writeJSON(w, http.StatusAccepted, status)
+	return nil
+}
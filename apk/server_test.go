@@ -0,0 +1,241 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T, opts ...Option) (*Server, *httptest.Server) {
+	t.Helper()
+	store, err := OpenStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := New(append([]Option{WithStore(store), WithOutputRoot(t.TempDir()), WithProgress(NoProgress{})}, opts...)...)
+	jobs, err := OpenJobQueue(u, DefaultJobsFile(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(u, jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+	return server, srv
+}
+
+func getJSON(t *testing.T, url string, wantStatus int, v any) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("GET %s = %s, want %d", url, resp.Status, wantStatus)
+	}
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	server, srv := newTestServer(t)
+	assets := t.TempDir()
+	writeTree(t, assets, map[string]string{
+		"csv_logic/characters.csv": "\"Name\",\"Hitpoints\",\"Flying\"\n\"String\",\"int\",\"Boolean\"\n\"Barbarian\",\"45\",\"false\"\n\"Balloon\",,\"true\"\n",
+	})
+	if _, err := server.Updater.Store().Put(&BrawlStars, VersionData{Version: MustParseVersion("15.1.0"), Date: "Feb 1, 2023"}, assets); err != nil {
+		t.Fatal(err)
+	}
+
+	var games []GameInfo
+	getJSON(t, srv.URL+"/api/games", http.StatusOK, &games)
+	found := false
+	for _, g := range games {
+		if g.Slug == "brawlstars" {
+			found = g.Versions == 1 && g.Latest == "15.1.0" && g.Package == BrawlStars.Package
+		}
+	}
+	if !found {
+		t.Errorf("/api/games = %+v, want brawlstars with 15.1.0", games)
+	}
+
+	var versions []VersionInfo
+	getJSON(t, srv.URL+"/api/games/Brawl%20Stars/versions", http.StatusOK, &versions)
+	if want := []VersionInfo{{Version: "15.1.0", Date: "Feb 1, 2023", Files: 1}}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("versions = %+v, want %+v", versions, want)
+	}
+
+	var m Manifest
+	getJSON(t, srv.URL+"/api/games/brawlstars/versions/15.1.0/files", http.StatusOK, &m)
+	if len(m.Files) != 1 || m.Files[0].Path != "csv_logic/characters.csv" {
+		t.Errorf("files = %+v", m.Files)
+	}
+
+	resp, err := http.Get(srv.URL + "/api/games/brawlstars/versions/15.1.0/files/csv_logic/characters.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != m.Files[0].Size {
+		t.Errorf("asset = %s with %d bytes, want %d", resp.Status, resp.ContentLength, m.Files[0].Size)
+	}
+
+	var table CSVTable
+	getJSON(t, srv.URL+"/api/games/brawlstars/versions/15.1.0/csv/csv_logic/characters.csv", http.StatusOK, &table)
+	if len(table.Rows) != 2 || table.Rows[0]["Hitpoints"] != float64(45) || table.Rows[1]["Flying"] != true {
+		t.Errorf("table = %+v", table)
+	}
+	if _, ok := table.Rows[1]["Hitpoints"]; ok {
+		t.Error("empty cells should be left out")
+	}
+
+	next := t.TempDir()
+	writeTree(t, next, map[string]string{"csv_logic/characters.csv": "\"Name\"\n\"String\"\n\"Barbarian\"\n", "csv_logic/new.csv": "x\n"})
+	if _, err = server.Updater.Store().Put(&BrawlStars, VersionData{Version: MustParseVersion("15.2.0")}, next); err != nil {
+		t.Fatal(err)
+	}
+	var diff VersionDiff
+	getJSON(t, srv.URL+"/api/games/brawlstars/diff?from=15.1.0&to=15.2.0", http.StatusOK, &diff)
+	want := &AssetChanges{Added: []string{"csv_logic/new.csv"}, Removed: []string{}, Modified: []string{"csv_logic/characters.csv"}}
+	if diff.From != "15.1.0" || diff.To != "15.2.0" || !reflect.DeepEqual(diff.Changes, want) {
+		t.Errorf("diff = %+v, want %+v", diff, want)
+	}
+	getJSON(t, srv.URL+"/api/games/brawlstars/diff?from=15.1.0", http.StatusBadRequest, nil)
+
+	getJSON(t, srv.URL+"/api/games/nosuchgame/versions", http.StatusNotFound, nil)
+	getJSON(t, srv.URL+"/api/games/brawlstars/versions/9.9.9/files", http.StatusNotFound, nil)
+	getJSON(t, srv.URL+"/api/games/brawlstars/versions/15.1.0/files/missing.csv", http.StatusNotFound, nil)
+	getJSON(t, srv.URL+"/api/games/brawlstars/versions/latest/files", http.StatusBadRequest, nil)
+	getJSON(t, srv.URL+"/api/games/brawlstars/fetch", http.StatusMethodNotAllowed, nil)
+
+	if _, err = NewServer(New(), nil); err == nil {
+		t.Error("NewServer() without a store should fail")
+	}
+}
+
+func TestServerFetch(t *testing.T) {
+	fakeApktool(t, "no-failures")
+	versions, _ := newFakeVersionsServer(t, 1, 2)
+	server, srv := newTestServer(t, WithSource(testSource(versions.URL)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Jobs.Run(ctx)
+
+	post := func() FetchStatus {
+		resp, err := http.Post(srv.URL+"/api/games/brawlstars/fetch?version=1.1.0", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status FetchStatus
+		if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	status := post()
+	if status.Status != FetchQueued || status.Version != "1.1.0" || status.Job == nil {
+		t.Fatalf("first fetch = %+v, want a queued job", status)
+	}
+	job, err := server.Jobs.Wait(ctx, status.Job.ID)
+	if err != nil || job.Status != JobSucceeded {
+		t.Fatalf("job = %+v, %v, want succeeded", job, err)
+	}
+
+	var listed Job
+	getJSON(t, srv.URL+"/api/jobs/"+job.ID, http.StatusOK, &listed)
+	if listed.Status != JobSucceeded || len(listed.Logs) == 0 {
+		t.Errorf("/api/jobs/%s = %+v, want succeeded with logs", job.ID, listed)
+	}
+	getJSON(t, srv.URL+"/api/jobs/404", http.StatusNotFound, nil)
+
+	if _, err := server.Updater.Store().Manifest("brawlstars", "1.1.0"); err != nil {
+		t.Fatalf("fetched version isn't stored: %v", err)
+	}
+	if status := post(); status.Status != FetchStored {
+		t.Errorf("second fetch = %+v, want stored", status)
+	}
+
+	// A version that isn't listed is never fetched, the app page would hand out the current APK instead
+	resp, err := http.Post(srv.URL+"/api/games/brawlstars/fetch?version=99.9.9", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("fetch of an unlisted version answered %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if jobs := server.Jobs.Jobs(); len(jobs) != 1 {
+		t.Errorf("an unlisted version queued a job: %+v", jobs)
+	}
+}
+
+func TestParseCSVTable(t *testing.T) {
+	table, err := ParseCSVTable(strings.NewReader("Name,Count,Enabled,Note\nString,int,boolean,String\nA,3,TRUE,x\nB,many,,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantColumns := []CSVColumn{{"Name", "String"}, {"Count", "int"}, {"Enabled", "boolean"}, {"Note", "String"}}
+	if !reflect.DeepEqual(table.Columns, wantColumns) {
+		t.Errorf("columns = %+v", table.Columns)
+	}
+	wantRows := []map[string]any{
+		{"Name": "A", "Count": int64(3), "Enabled": true, "Note": "x"},
+		{"Name": "B", "Count": "many"}, // not an int, kept as is
+	}
+	if !reflect.DeepEqual(table.Rows, wantRows) {
+		t.Errorf("rows = %+v, want %+v", table.Rows, wantRows)
+	}
+
+	if _, err = ParseCSVTable(strings.NewReader("")); err == nil {
+		t.Error("expected an error for an empty file")
+	}
+}
+
+func TestServerUI(t *testing.T) {
+	server, srv := newTestServer(t)
+	getJSON(t, srv.URL+"/", http.StatusNotFound, nil)
+
+	server.UI = true
+	for _, page := range []string{"/", "/app.js", "/style.css"} {
+		resp, err := http.Get(srv.URL + page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s = %s", page, resp.Status)
+		}
+	}
+	getJSON(t, srv.URL+"/api/nothing", http.StatusNotFound, nil)
+}
@@ -0,0 +1,357 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A content addressed store of decompressed assets. Every unique file is kept once as a blob named after its
+// sha256 and each stored version is a manifest mapping paths to blobs:
+//
+//	blobs/ab/abcdef...
+//	manifests/clashofclans/15.83.24.json
+type Store struct {
+	Dir string
+
+	mu sync.RWMutex // Put holds it shared and GC exclusively, see GC for other processes
+}
+
+// Blobs younger than this are never collected, a Put in another process may not have written their manifest yet
+const GCGracePeriod = time.Hour
+
+// Returned for versions that were never stored or were deleted
+var ErrNotStored = errors.New("isn't in the store")
+
+// One file of a stored version
+type ManifestEntry struct {
+	Path string `json:"path"` // slash separated, relative to the assets folder
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// The file listing of a stored version
+type Manifest struct {
+	Game    string          `json:"game"`
+	Version string          `json:"version"`
+	Date    string          `json:"date,omitempty"`
+	Files   []ManifestEntry `json:"files"`
+}
+
+// Returns the entry for path, if the version has it
+func (m *Manifest) Lookup(path string) (ManifestEntry, bool) {
+	i := sort.Search(len(m.Files), func(i int) bool { return m.Files[i].Path >= path })
+	if i < len(m.Files) && m.Files[i].Path == path {
+		return m.Files[i], true
+	}
+	return ManifestEntry{}, false
+}
+
+// Compares two stored versions, like DiffAssetTrees without reading any file
+func DiffManifests(old, new *Manifest) *AssetChanges {
+	changes := &AssetChanges{Added: []string{}, Removed: []string{}, Modified: []string{}}
+	for _, f := range new.Files {
+		prev, ok := old.Lookup(f.Path)
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, f.Path)
+		case prev.Hash != f.Hash:
+			changes.Modified = append(changes.Modified, f.Path)
+		}
+	}
+	for _, f := range old.Files {
+		if _, ok := new.Lookup(f.Path); !ok {
+			changes.Removed = append(changes.Removed, f.Path)
+		}
+	}
+	return changes
+}
+
+// Opens the store at dir, creating it if needed
+func OpenStore(dir string) (*Store, error) {
+	for _, sub := range []string{"blobs", "manifests"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{Dir: dir}, nil
+}
+
+// Where the store lives unless told otherwise, e.g. ~/.local/share/apk-updater/store
+func DefaultStoreDir() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "apk-updater", "store")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".", "store")
+	}
+	return filepath.Join(home, ".local", "share", "apk-updater", "store")
+}
+
+// Where the blob with this hash is kept
+func (s *Store) BlobPath(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(s.Dir, "blobs", hash)
+	}
+	return filepath.Join(s.Dir, "blobs", hash[:2], hash)
+}
+
+func (s *Store) Open(hash string) (*os.File, error) {
+	return os.Open(s.BlobPath(hash))
+}
+
+func (s *Store) manifestPath(game, version string) string {
+	return filepath.Join(s.Dir, "manifests", game, version+".json")
+}
+
+// Copies every file under assetsDir into the store and writes the version's manifest, assetsDir is left as it is
+func (s *Store) Put(game *GameLink, version VersionData, assetsDir string) (*Manifest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := &Manifest{Game: game.Slug(), Version: version.Version.String(), Date: version.Date, Files: []ManifestEntry{}}
+	err := filepath.WalkDir(assetsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(assetsDir, path)
+		if err != nil {
+			return err
+		}
+		entry, err := s.putFile(path)
+		if err != nil {
+			return err
+		}
+		entry.Path = filepath.ToSlash(rel)
+		m.Files = append(m.Files, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	fp := s.manifestPath(m.Game, m.Version)
+	if err = os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return nil, err
+	}
+	return m, writeFileAtomic(fp, data)
+}
+
+// Copies a file into the store unless its blob already exists
+func (s *Store) putFile(path string) (ManifestEntry, error) {
+	sum, err := hashFile(path)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	entry := ManifestEntry{Hash: hex.EncodeToString(sum[:]), Size: info.Size()}
+
+	blob := s.BlobPath(entry.Hash)
+	if _, err = os.Stat(blob); errors.Is(err, fs.ErrNotExist) {
+		if err = os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return entry, err
+		}
+		if err = copyFileAtomic(path, blob); err != nil {
+			return entry, err
+		}
+	} else if err != nil {
+		return entry, err
+	} else {
+		now := time.Now()
+		_ = os.Chtimes(blob, now, now) // reused, so GC in another process gives it the full grace period again
+	}
+	return entry, nil
+}
+
+// Blobs are read-only so editing a hardlinked tree can't corrupt the store
+func copyFileAtomic(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0444); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// Reads a stored version's manifest, game is the game's slug
+func (s *Store) Manifest(game, version string) (*Manifest, error) {
+	data, err := os.ReadFile(s.manifestPath(game, version))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s %s %w", game, version, ErrNotStored)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("reading manifest of %s %s: %w", game, version, err)
+	}
+	return m, nil
+}
+
+// Lists the slugs of every game with at least one stored version
+func (s *Store) Games() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Dir, "manifests"))
+	if err != nil {
+		return nil, err
+	}
+	games := make([]string, 0)
+	for _, e := range entries {
+		if e.IsDir() {
+			games = append(games, e.Name())
+		}
+	}
+	return games, nil
+}
+
+// Lists the stored versions of a game, newest first
+func (s *Store) Versions(game string) ([]Version, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Dir, "manifests", game))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Version{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, 0)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		v, err := ParseVersion(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Compare(versions[j]) > 0 })
+	return versions, nil
+}
+
+// Drops a version's manifest, its blobs stay until the next GC
+func (s *Store) Delete(game, version string) error {
+	err := os.Remove(s.manifestPath(game, version))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s %s %w", game, version, ErrNotStored)
+	}
+	return err
+}
+
+// Recreates a stored version's tree at dst, hardlinking blobs unless copy is set or linking fails
+func (s *Store) Materialize(m *Manifest, dst string, copy bool) error {
+	for _, f := range m.Files {
+		target := filepath.Join(dst, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		os.Remove(target)
+		if !copy && os.Link(s.BlobPath(f.Hash), target) == nil {
+			continue
+		}
+		if err := copyFile(s.BlobPath(f.Hash), target); err != nil {
+			return fmt.Errorf("materializing %s: %w", f.Path, err)
+		}
+	}
+	return nil
+}
+
+// Removes every blob no manifest references, returning how many were removed and how many bytes that freed.
+// Puts through this Store wait for it, but GC shouldn't run while another process writes to the store:
+// only blobs older than GCGracePeriod and no temporary files are removed to make that less likely to bite
+func (s *Store) GC() (removed int, freed int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	referenced := make(map[string]bool)
+	games, err := s.Games()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, game := range games {
+		versions, err := s.Versions(game)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, v := range versions {
+			m, err := s.Manifest(game, v.String())
+			if err != nil {
+				return 0, 0, err
+			}
+			for _, f := range m.Files {
+				referenced[f.Hash] = true
+			}
+		}
+	}
+
+	err = filepath.WalkDir(filepath.Join(s.Dir, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || referenced[d.Name()] || strings.HasSuffix(d.Name(), ".tmp") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < GCGracePeriod {
+			return nil
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
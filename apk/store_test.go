@@ -0,0 +1,142 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, next := t.TempDir(), t.TempDir()
+	writeTree(t, old, map[string]string{"csv_logic/characters.csv": "Barbarian,1\n", "localization/texts.csv": "TID\n"})
+	writeTree(t, next, map[string]string{"csv_logic/characters.csv": "Barbarian,2\n", "localization/texts.csv": "TID\n", "logic/new.csv": "x\n"})
+
+	m1, err := store.Put(&BrawlStars, VersionData{Version: MustParseVersion("15.0.1")}, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := store.Put(&BrawlStars, VersionData{Version: MustParseVersion("15.1.0"), Date: "Feb 1, 2023"}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The source tree stays its own, rewriting a file there can't reach the blob other versions share
+	texts := filepath.Join(next, "localization", "texts.csv") // m2.Files[1], they're sorted by path
+	if err = os.WriteFile(texts, []byte("edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if blob, err := os.ReadFile(store.BlobPath(m2.Files[1].Hash)); err != nil || string(blob) != "TID\n" {
+		t.Errorf("editing the stored tree changed its blob to %q (%v)", blob, err)
+	}
+	if err = os.WriteFile(texts, []byte("TID\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// texts.csv is shared, so 4 unique files across 5 entries
+	if blobs := countFiles(t, filepath.Join(store.Dir, "blobs")); blobs != 4 {
+		t.Errorf("store has %d blobs, want 4", blobs)
+	}
+
+	changes := DiffManifests(m1, m2)
+	want := &AssetChanges{Added: []string{"logic/new.csv"}, Removed: []string{}, Modified: []string{"csv_logic/characters.csv"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("DiffManifests() = %+v, want %+v", changes, want)
+	}
+
+	versions, err := store.Versions("brawlstars")
+	if err != nil || len(versions) != 2 || versions[0].String() != "15.1.0" {
+		t.Errorf("Versions() = %v, %v", versions, err)
+	}
+
+	read, err := store.Manifest("brawlstars", "15.1.0")
+	if err != nil || !reflect.DeepEqual(read, m2) {
+		t.Errorf("Manifest() = %+v, %v, want %+v", read, err, m2)
+	}
+
+	for _, copy := range []bool{false, true} {
+		out := t.TempDir()
+		if err = store.Materialize(m2, out, copy); err != nil {
+			t.Fatal(err)
+		}
+		changes, err := DiffAssetTrees(next, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !changes.Empty() {
+			t.Errorf("materialized tree (copy %v) differs: %s", copy, changes.Summary())
+		}
+	}
+
+	// Dropping the older version leaves only its changed characters.csv unreferenced
+	if err = store.Delete("brawlstars", "15.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	// Fresh blobs and temporary files might belong to a Put that hasn't written its manifest yet
+	tmp := filepath.Join(store.Dir, "blobs", "ab", "abcdef.123.tmp")
+	writeTree(t, filepath.Join(store.Dir, "blobs"), map[string]string{"ab/abcdef.123.tmp": "partial"})
+	if removed, _, err := store.GC(); err != nil || removed != 0 {
+		t.Fatalf("GC() removed %d fresh blobs (%v), want none", removed, err)
+	}
+	stale := time.Now().Add(-2 * GCGracePeriod)
+	_ = filepath.WalkDir(filepath.Join(store.Dir, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			err = os.Chtimes(path, stale, stale)
+		}
+		return err
+	})
+
+	removed, freed, err := store.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("GC() removed a temporary file: %v", err)
+	}
+	if removed != 1 || freed != int64(len("Barbarian,1\n")) {
+		t.Errorf("GC() removed %d blobs (%d bytes), want 1 (%d bytes)", removed, freed, len("Barbarian,1\n"))
+	}
+	if _, err = store.Manifest("brawlstars", "15.0.1"); err == nil {
+		t.Error("a deleted version is still in the store")
+	}
+}
+
+func countFiles(t *testing.T, root string) int {
+	t.Helper()
+	n := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
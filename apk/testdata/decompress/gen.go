@@ -0,0 +1,147 @@
+//go:build ignore
+
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Generates the decompression corpus: assets/ holds Supercell-compressed files in every format and a few broken
+// ones, expected/ what WalkAndDecompressAssets must turn the decodable ones into. Run from the apk folder with
+//
+//	go run testdata/decompress/gen.go
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const root = "testdata/decompress"
+
+var characters = `"Name","Hitpoints","Speed","Flying","TID"
+"String","int","int","Boolean","String"
+"Barbarian","45","16","false","TID_BARBARIAN"
+"Archer","20","24","false","TID_ARCHER"
+"Balloon","150","10","true","TID_BALLOON"
+` + strings.Repeat(`"Dummy","1","1","false","TID_DUMMY"`+"\n", 40)
+
+var texts = `"TID","EN","FR"
+"String","String","String"
+"TID_BARBARIAN","Barbarian","Barbare"
+"TID_ARCHER","Archer","Archère"
+`
+
+// Supercell's LZMA: the .lzma header with its 8 byte size cut down to 4 bytes
+func scLZMA(data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := lzma.WriterConfig{SizeInHeader: true, Size: int64(len(data))}.NewWriter(&buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		log.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		log.Fatal(err)
+	}
+	out := buf.Bytes()
+	return append(append([]byte{}, out[:9]...), out[13:]...)
+}
+
+// The SC header: magic, version, hash length and an MD5 of the decompressed data, 26 bytes in all
+func scHeader(version uint32, data []byte) []byte {
+	header := []byte("SC")
+	header = binary.BigEndian.AppendUint32(header, version)
+	header = binary.BigEndian.AppendUint32(header, md5.Size)
+	sum := md5.Sum(data)
+	return append(header, sum[:]...)
+}
+
+func write(path string, data []byte) {
+	path = filepath.Join(root, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	if err := os.RemoveAll(root + "/assets"); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.RemoveAll(root + "/expected"); err != nil {
+		log.Fatal(err)
+	}
+
+	csv := []byte(characters)
+	compressed := scLZMA(csv)
+
+	// Decodable, each must come out as expected/<same path>
+	good := map[string][]byte{
+		"csv_logic/lzma.csv":     compressed,
+		"csv_logic/sc.csv":       append(scHeader(1, csv), compressed...),
+		"csv_logic/sig.csv":      append(append([]byte("Sig:"), bytes.Repeat([]byte{0xA5}, 64)...), compressed...),
+		"csv_logic/plain.csv":    csv,
+		"csv_logic/short.csv":    []byte("\"Name\"\n\"String\"\n"),
+		"csv_logic/empty.csv":    {},
+		"localization/texts.csv": scLZMA([]byte(texts)),
+	}
+	for path, data := range good {
+		write("assets/"+path, data)
+	}
+	for path, want := range map[string]string{
+		"csv_logic/lzma.csv":     characters,
+		"csv_logic/sc.csv":       characters,
+		"csv_logic/sig.csv":      characters,
+		"csv_logic/plain.csv":    characters,
+		"csv_logic/short.csv":    "\"Name\"\n\"String\"\n",
+		"csv_logic/empty.csv":    "",
+		"localization/texts.csv": texts,
+	} {
+		write("expected/"+path, []byte(want))
+	}
+
+	// Formats the decompressor doesn't handle and broken files, each must be reported as failed
+	lzham := append(scHeader(1, csv), []byte("SCLZ")...)
+	lzham = append(lzham, 18)
+	lzham = binary.LittleEndian.AppendUint32(lzham, uint32(len(csv)))
+	lzham = append(lzham, bytes.Repeat([]byte{0x3C}, 32)...)
+	zstdFrame := []byte{0x28, 0xB5, 0x2F, 0xFD, 0x20, 0x10, 0x81, 0x00, 0x00, 0x4E, 0x61, 0x6D, 0x65, 0x0A}
+	bad := map[string][]byte{
+		"csv_logic/lzham.csv":     lzham,
+		"csv_logic/zstd.csv":      zstdFrame,
+		"csv_logic/sc_zstd.csv":   append(scHeader(3, csv), zstdFrame...),
+		"csv_logic/truncated.csv": compressed[:len(compressed)/2],
+		"csv_logic/tiny.csv":      {0x5D, 0x00, 0x00, 0x04, 0x00, 0x00}, // too short for the LZMA header, used to panic
+		"csv_logic/garbage.csv":   append([]byte{0x5D, 0x00, 0x00, 0x04, 0x00, 0xFF, 0xFF, 0xFF, 0xFF}, bytes.Repeat([]byte{0xFF}, 48)...),
+	}
+	for path, data := range bad {
+		write("assets/"+path, data)
+	}
+
+	// Outside the decompressed folders, must be left alone
+	write("assets/sc/ui.sc", compressed)
+}
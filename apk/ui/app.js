@@ -0,0 +1,311 @@
+// The apk-updater web UI: browse stored games, versions and CSV tables and diff two versions.
+// Everything comes from the JSON API served next to this file, pages are picked by the URL hash.
+"use strict";
+
+const view = document.getElementById("view");
+const crumbs = document.getElementById("crumbs");
+
+// Rows rendered at once in a table, the search narrows down the rest
+const MAX_ROWS = 2000;
+// Unchanged lines shown around each change in a diff
+const CONTEXT = 3;
+// Diffs needing more edits than this are shown as a plain replacement
+const MAX_EDITS = 3000;
+
+const enc = encodeURIComponent;
+
+function esc(s) {
+  return String(s).replace(/[&<>"']/g, c => ({ "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" })[c]);
+}
+
+// Encodes a slash separated asset path, keeping the slashes
+function encPath(path) {
+  return path.split("/").map(enc).join("/");
+}
+
+async function api(path) {
+  const resp = await fetch("api/" + path);
+  if (!resp.ok) {
+    let message = resp.statusText;
+    try { message = (await resp.json()).error; } catch (_) { /* not JSON */ }
+    throw new Error(message);
+  }
+  return resp.json();
+}
+
+async function raw(game, version, path) {
+  const resp = await fetch(`api/games/${enc(game)}/versions/${enc(version)}/files/${encPath(path)}`);
+  if (!resp.ok) throw new Error(`${path} in ${version}: ${resp.statusText}`);
+  return resp.text();
+}
+
+function setCrumbs(links) {
+  crumbs.innerHTML = links.map(([href, label]) => `<a href="${href}">${esc(label)}</a>`).join(" ");
+}
+
+// ---- Pages ----
+
+async function gamesPage() {
+  setCrumbs([]);
+  const games = await api("games");
+  const stored = games.filter(g => g.versions > 0);
+  const rows = stored.map(g => `<tr>
+      <td><a href="#/g/${enc(g.slug)}">${esc(g.name)}</a></td>
+      <td class="num">${g.versions}</td>
+      <td>${esc(g.latest || "")}</td>
+    </tr>`).join("");
+  view.innerHTML = `<h1>Games</h1>` + (stored.length === 0
+    ? `<p class="muted">The store is empty, fetch a version first.</p>`
+    : `<table><thead><tr><th>Game</th><th>Versions</th><th>Latest</th></tr></thead><tbody>${rows}</tbody></table>`);
+}
+
+async function versionsPage(game) {
+  setCrumbs([[`#/g/${enc(game)}`, game]]);
+  const versions = await api(`games/${enc(game)}/versions`);
+  const rows = versions.map((v, i) => `<tr>
+      <td><input type="radio" name="from" value="${esc(v.version)}" ${i === 1 ? "checked" : ""}></td>
+      <td><input type="radio" name="to" value="${esc(v.version)}" ${i === 0 ? "checked" : ""}></td>
+      <td><a href="#/g/${enc(game)}/v/${enc(v.version)}">${esc(v.version)}</a></td>
+      <td>${esc(v.date || "")}</td>
+      <td class="num">${v.files}</td>
+    </tr>`).join("");
+  view.innerHTML = `<h1>${esc(game)}</h1>
+    <div class="toolbar"><button id="compare" ${versions.length < 2 ? "disabled" : ""}>Compare selected versions</button></div>
+    <table><thead><tr><th>From</th><th>To</th><th>Version</th><th>Released</th><th>Files</th></tr></thead>
+    <tbody>${rows}</tbody></table>`;
+  document.getElementById("compare").onclick = () => {
+    const from = view.querySelector("input[name=from]:checked");
+    const to = view.querySelector("input[name=to]:checked");
+    if (from && to && from.value !== to.value) {
+      location.hash = `#/g/${enc(game)}/d/${enc(from.value)}/${enc(to.value)}`;
+    }
+  };
+}
+
+async function filesPage(game, version) {
+  setCrumbs([[`#/g/${enc(game)}`, game], [`#/g/${enc(game)}/v/${enc(version)}`, version]]);
+  const manifest = await api(`games/${enc(game)}/versions/${enc(version)}/files`);
+  view.innerHTML = `<h1>${esc(game)} ${esc(version)}</h1>
+    <div class="toolbar"><input type="search" id="filter" placeholder="Filter ${manifest.files.length} files"></div>
+    <ul class="files" id="files"></ul>`;
+  const list = document.getElementById("files");
+  const render = query => {
+    list.innerHTML = manifest.files
+      .filter(f => f.path.toLowerCase().includes(query))
+      .map(f => {
+        const href = f.path.endsWith(".csv")
+          ? `#/g/${enc(game)}/v/${enc(version)}/t/${encPath(f.path)}`
+          : `api/games/${enc(game)}/versions/${enc(version)}/files/${encPath(f.path)}`;
+        return `<li><a href="${href}">${esc(f.path)}</a> <span class="muted">${formatSize(f.size)}</span></li>`;
+      }).join("");
+  };
+  document.getElementById("filter").oninput = e => render(e.target.value.toLowerCase());
+  render("");
+}
+
+async function tablePage(game, version, path) {
+  setCrumbs([[`#/g/${enc(game)}`, game], [`#/g/${enc(game)}/v/${enc(version)}`, version], [location.hash, path]]);
+  const table = await api(`games/${enc(game)}/versions/${enc(version)}/csv/${encPath(path)}`);
+  view.innerHTML = `<h1>${esc(path)}</h1>
+    <div class="toolbar">
+      <input type="search" id="search" placeholder="Search ${table.rows.length} rows">
+      <span class="muted" id="count"></span>
+      <a href="api/games/${enc(game)}/versions/${enc(version)}/files/${encPath(path)}">Download</a>
+    </div>
+    <div class="scroll"><table id="table"></table></div>`;
+
+  const el = document.getElementById("table");
+  const count = document.getElementById("count");
+  let query = "";
+  let sort = { column: null, dir: 1 };
+
+  const render = () => {
+    let rows = table.rows;
+    if (query) {
+      rows = rows.filter(row => Object.values(row).some(v => String(v).toLowerCase().includes(query)));
+    }
+    if (sort.column !== null) {
+      const name = sort.column;
+      rows = rows.slice().sort((a, b) => sort.dir * compareValues(a[name], b[name]));
+    }
+    count.textContent = rows.length > MAX_ROWS
+      ? `showing ${MAX_ROWS} of ${rows.length} rows`
+      : `${rows.length} rows`;
+
+    const head = table.columns.map(c => {
+      const cls = sort.column === c.name ? (sort.dir > 0 ? "asc" : "desc") : "";
+      return `<th class="sortable ${cls}" data-column="${esc(c.name)}">${esc(c.name)}<small>${esc(c.type)}</small></th>`;
+    }).join("");
+    const body = rows.slice(0, MAX_ROWS).map(row => "<tr>" + table.columns.map(c => {
+      const v = row[c.name];
+      return v === undefined ? "<td></td>" : `<td class="${typeof v === "number" ? "num" : ""}">${esc(v)}</td>`;
+    }).join("") + "</tr>").join("");
+    el.innerHTML = `<thead><tr>${head}</tr></thead><tbody>${body}</tbody>`;
+  };
+
+  el.onclick = e => {
+    const th = e.target.closest("th");
+    if (!th) return;
+    const column = th.dataset.column;
+    sort = sort.column === column ? { column, dir: -sort.dir } : { column, dir: 1 };
+    render();
+  };
+  document.getElementById("search").oninput = e => {
+    query = e.target.value.toLowerCase();
+    render();
+  };
+  render();
+}
+
+async function diffPage(game, from, to) {
+  setCrumbs([[`#/g/${enc(game)}`, game], [location.hash, `${from} → ${to}`]]);
+  const diff = await api(`games/${enc(game)}/diff?from=${enc(from)}&to=${enc(to)}`);
+  const section = (title, kind, paths) => {
+    if (paths.length === 0) return "";
+    const items = paths.slice().sort().map(p =>
+      `<li class="${kind}"><a href="#/g/${enc(game)}/d/${enc(from)}/${enc(to)}/f/${encPath(p)}">${esc(p)}</a></li>`).join("");
+    return `<h2>${title} (${paths.length})</h2><ul class="files">${items}</ul>`;
+  };
+  const c = diff.changes;
+  view.innerHTML = `<h1>${esc(game)}: ${esc(diff.from)} → ${esc(diff.to)}</h1>` +
+    (c.added.length + c.removed.length + c.modified.length === 0
+      ? `<p class="muted">No asset changed.</p>`
+      : section("Modified", "modified", c.modified) + section("Added", "added", c.added) + section("Removed", "removed", c.removed));
+}
+
+async function fileDiffPage(game, from, to, path) {
+  setCrumbs([[`#/g/${enc(game)}`, game], [`#/g/${enc(game)}/d/${enc(from)}/${enc(to)}`, `${from} → ${to}`], [location.hash, path]]);
+  const diff = await api(`games/${enc(game)}/diff?from=${enc(from)}&to=${enc(to)}`);
+  const c = diff.changes;
+  const [oldText, newText] = await Promise.all([
+    c.added.includes(path) ? "" : raw(game, from, path),
+    c.removed.includes(path) ? "" : raw(game, to, path),
+  ]);
+  view.innerHTML = `<h1>${esc(path)}</h1>
+    <div class="scroll"><table class="diff">
+      <colgroup><col class="ln"><col><col class="ln"><col></colgroup>
+      <thead><tr><th colspan="2">${esc(from)}</th><th colspan="2">${esc(to)}</th></tr></thead>
+      <tbody>${sideBySide(splitLines(oldText), splitLines(newText))}</tbody>
+    </table></div>`;
+}
+
+// ---- Helpers ----
+
+function formatSize(n) {
+  if (n < 1024) return `${n} B`;
+  if (n < 1024 * 1024) return `${(n / 1024).toFixed(1)} KB`;
+  return `${(n / 1024 / 1024).toFixed(1)} MB`;
+}
+
+// Numbers sort numerically, missing values last, everything else as text
+function compareValues(a, b) {
+  if (a === undefined || b === undefined) return (a === undefined) - (b === undefined);
+  if (typeof a === "number" && typeof b === "number") return a - b;
+  return String(a).localeCompare(String(b), undefined, { numeric: true });
+}
+
+function splitLines(text) {
+  if (text === "") return [];
+  const lines = text.replace(/\r\n/g, "\n").split("\n");
+  if (lines[lines.length - 1] === "") lines.pop();
+  return lines;
+}
+
+// Myers' diff of two line arrays as a list of ["=", "-", "+", line] ops, null if it needs more than MAX_EDITS edits
+function diffLines(a, b) {
+  const n = a.length, m = b.length, max = n + m, off = max + 1;
+  const v = new Int32Array(2 * max + 3);
+  const trace = [null];
+  for (let d = 0; d <= Math.min(max, MAX_EDITS); d++) {
+    if (d > 0) trace.push(v.slice(off - d + 1, off + d));
+    for (let k = -d; k <= d; k += 2) {
+      let x = (k === -d || (k !== d && v[off + k - 1] < v[off + k + 1])) ? v[off + k + 1] : v[off + k - 1] + 1;
+      let y = x - k;
+      while (x < n && y < m && a[x] === b[y]) { x++; y++; }
+      v[off + k] = x;
+      if (x >= n && y >= m) return backtrack(trace, a, b, d);
+    }
+  }
+  return null;
+}
+
+function backtrack(trace, a, b, edits) {
+  const ops = [];
+  let x = a.length, y = b.length;
+  for (let d = edits; d > 0; d--) {
+    const prev = trace[d]; // the furthest x per diagonal after d-1 edits, indexed by k + d - 1
+    const k = x - y;
+    const prevK = (k === -d || (k !== d && prev[k - 1 + d - 1] < prev[k + 1 + d - 1])) ? k + 1 : k - 1;
+    const prevX = prev[prevK + d - 1], prevY = prevX - prevK;
+    while (x > prevX && y > prevY) ops.push(["=", a[--x]]), y--;
+    if (x === prevX) ops.push(["+", b[--y]]);
+    else ops.push(["-", a[--x]]);
+  }
+  while (x > 0 && y > 0) ops.push(["=", a[--x]]), y--;
+  return ops.reverse();
+}
+
+// Renders the diff as table rows, deletions and insertions next to each other and long unchanged runs folded
+function sideBySide(a, b) {
+  const ops = diffLines(a, b) || [...a.map(l => ["-", l]), ...b.map(l => ["+", l])];
+  const rows = [];
+  let oldLine = 0, newLine = 0;
+  for (let i = 0; i < ops.length;) {
+    if (ops[i][0] === "=") {
+      let j = i;
+      while (j < ops.length && ops[j][0] === "=") j++;
+      const run = j - i;
+      const head = i === 0 ? 0 : CONTEXT, tail = j === ops.length ? 0 : CONTEXT;
+      for (let r = 0; r < run; r++) {
+        oldLine++; newLine++;
+        if (r < head || r >= run - tail || run <= head + tail + 1) {
+          rows.push(row("", oldLine, ops[i + r][1], newLine, ops[i + r][1]));
+        } else if (r === head) {
+          rows.push(`<tr class="gap"><td colspan="4">${run - head - tail} unchanged lines</td></tr>`);
+        }
+      }
+      i = j;
+      continue;
+    }
+    const dels = [], adds = [];
+    while (i < ops.length && ops[i][0] !== "=") {
+      (ops[i][0] === "-" ? dels : adds).push(ops[i][1]);
+      i++;
+    }
+    for (let r = 0; r < Math.max(dels.length, adds.length); r++) {
+      const hasOld = r < dels.length, hasNew = r < adds.length;
+      rows.push(row(hasOld && hasNew ? "change" : hasOld ? "del" : "add",
+        hasOld ? ++oldLine : "", hasOld ? dels[r] : "",
+        hasNew ? ++newLine : "", hasNew ? adds[r] : ""));
+    }
+  }
+  return rows.join("") || `<tr class="gap"><td colspan="4">Both files are empty</td></tr>`;
+}
+
+function row(kind, oldNo, oldText, newNo, newText) {
+  const oldCls = kind === "change" || kind === "del" ? "del" : "";
+  const newCls = kind === "change" || kind === "add" ? "add" : "";
+  return `<tr class="${kind}"><td class="ln">${oldNo}</td><td class="old ${oldCls}">${esc(oldText)}</td>` +
+    `<td class="ln">${newNo}</td><td class="new ${newCls}">${esc(newText)}</td></tr>`;
+}
+
+// ---- Routing ----
+
+async function route() {
+  const parts = location.hash.replace(/^#\/?/, "").split("/").filter(p => p !== "").map(decodeURIComponent);
+  const rest = i => parts.slice(i).join("/");
+  try {
+    if (parts.length === 0) await gamesPage();
+    else if (parts[0] === "g" && parts.length === 2) await versionsPage(parts[1]);
+    else if (parts[0] === "g" && parts[2] === "v" && parts.length === 4) await filesPage(parts[1], parts[3]);
+    else if (parts[0] === "g" && parts[2] === "v" && parts[4] === "t") await tablePage(parts[1], parts[3], rest(5));
+    else if (parts[0] === "g" && parts[2] === "d" && parts.length === 5) await diffPage(parts[1], parts[3], parts[4]);
+    else if (parts[0] === "g" && parts[2] === "d" && parts[5] === "f") await fileDiffPage(parts[1], parts[3], parts[4], rest(6));
+    else view.innerHTML = `<p class="error">Nothing here, go back to the <a href="#/">games</a>.</p>`;
+  } catch (err) {
+    view.innerHTML = `<p class="error">${esc(err.message)}</p>`;
+  }
+}
+
+window.addEventListener("hashchange", route);
+route();
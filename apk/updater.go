@@ -0,0 +1,271 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Where game versions and their download links are scraped from
+type Source interface {
+	Name() string
+	// Format string for a game's versions pages, %d is replaced by the page number
+	VersionsURL(game *GameLink) string
+	// The game's main page, listing its current version
+	AppURL(game *GameLink) string
+}
+
+type uptodown struct{}
+
+func (uptodown) Name() string {
+	return "uptodown"
+}
+
+func (u uptodown) VersionsURL(game *GameLink) string {
+	if game.URL != "" {
+		return game.URL
+	}
+	return fmt.Sprintf("https://%s.en.uptodown.com/android/versions/%%d", game.SourceSlug(u.Name()))
+}
+
+func (u uptodown) AppURL(game *GameLink) string {
+	return strings.TrimSuffix(u.VersionsURL(game), "/versions/%d")
+}
+
+// The default source, https://en.uptodown.com
+var Uptodown Source = uptodown{}
+
+// Every source that can be picked by name
+var Sources = []Source{Uptodown}
+
+// Looks a source up by its name, ignoring case
+func FindSource(name string) (Source, error) {
+	for _, source := range Sources {
+		if strings.EqualFold(source.Name(), name) {
+			return source, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown source %q", name)
+}
+
+// Downloads, decompiles and decompresses APKs. Every Updater has its own HTTP client, logger and state,
+// so several of them can live in one process. The package level functions use Default
+type Updater struct {
+	client       *retryablehttp.Client
+	log          *slog.Logger
+	outputRoot   string
+	source       Source
+	concurrency  int
+	pageInterval time.Duration
+	cacheDir     string
+	cacheTTL     time.Duration
+	hooks        *Hooks
+	store        *Store
+	progress     Progress
+	events       EventSink
+	metrics      *Metrics
+
+	mu              sync.Mutex
+	currentVersions map[string]string
+	downloadURLs    map[string]cachedURL
+	downloadURLTTL  time.Duration
+}
+
+type Option func(*Updater)
+
+// Sets the HTTP client used for every request
+func WithHTTPClient(client *retryablehttp.Client) Option {
+	return func(u *Updater) {
+		u.client = client
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(u *Updater) {
+		u.log = logger
+	}
+}
+
+// Sets the folder APKs and assets are written to when no explicit path is given, defaults to the working directory
+func WithOutputRoot(dir string) Option {
+	return func(u *Updater) {
+		u.outputRoot = dir
+	}
+}
+
+func WithSource(source Source) Option {
+	return func(u *Updater) {
+		u.source = source
+	}
+}
+
+// Sets how many versions pages are fetched at once
+func WithConcurrency(n int) Option {
+	return func(u *Updater) {
+		u.concurrency = n
+	}
+}
+
+// Sets the minimum time between two versions page requests
+func WithPageInterval(interval time.Duration) Option {
+	return func(u *Updater) {
+		u.pageInterval = interval
+	}
+}
+
+// Sets the commands run after each step of Fetch
+func WithHooks(hooks *Hooks) Option {
+	return func(u *Updater) {
+		u.hooks = hooks
+	}
+}
+
+// Sets how downloads and decompression report their progress, defaults to a bar on a terminal and plain lines otherwise
+func WithProgress(progress Progress) Option {
+	return func(u *Updater) {
+		u.progress = progress
+	}
+}
+
+// Sends pipeline events (resolved versions, decompile steps, each asset, a final summary) to sink
+func WithEvents(sink EventSink) Option {
+	return func(u *Updater) {
+		u.events = sink
+	}
+}
+
+// Records downloads, decompressed assets and the watcher's checks in metrics
+func WithMetrics(metrics *Metrics) Option {
+	return func(u *Updater) {
+		u.metrics = metrics
+	}
+}
+
+// Adds every decompressed version to store once Fetch is done with it
+func WithStore(store *Store) Option {
+	return func(u *Updater) {
+		u.store = store
+	}
+}
+
+// Puts an on-disk cache of catalog pages in front of the updater's client, see CacheTransport
+func WithCache(dir string, ttl time.Duration) Option {
+	return func(u *Updater) {
+		u.cacheDir = dir
+		u.cacheTTL = ttl
+	}
+}
+
+func New(opts ...Option) *Updater {
+	u := &Updater{
+		outputRoot:      ".",
+		source:          Uptodown,
+		concurrency:     MaxConcurrentPages,
+		pageInterval:    PageInterval,
+		downloadURLs:    make(map[string]cachedURL),
+		currentVersions: make(map[string]string),
+		downloadURLTTL:  DownloadURLTTL,
+	}
+	for _, opt := range opts {
+		opt(u)
+	}
+	if u.client == nil {
+		u.client = LoadRetryClient()
+	}
+	if u.log == nil {
+		u.log = NewLogger()
+	}
+	if u.progress == nil {
+		u.progress, _ = NewProgress(ProgressAuto, os.Stdout)
+	}
+	if u.cacheDir != "" {
+		enableCache(u.client, u.log, u.cacheDir, u.cacheTTL)
+	}
+	return u
+}
+
+// A copy of u sharing its client, store and settings with opts applied on top, e.g. to give one run its own logger.
+// The copy has its own download link cache
+func (u *Updater) derive(opts ...Option) *Updater {
+	d := &Updater{
+		client:          u.client,
+		log:             u.log,
+		outputRoot:      u.outputRoot,
+		source:          u.source,
+		concurrency:     u.concurrency,
+		pageInterval:    u.pageInterval,
+		cacheDir:        u.cacheDir,
+		cacheTTL:        u.cacheTTL,
+		hooks:           u.hooks,
+		store:           u.store,
+		progress:        u.progress,
+		events:          u.events,
+		metrics:         u.metrics,
+		downloadURLs:    make(map[string]cachedURL),
+		currentVersions: make(map[string]string),
+		downloadURLTTL:  u.downloadURLTTL,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// The Updater behind the package level functions
+var Default = New(WithHTTPClient(Client), WithLogger(Log))
+
+func (u *Updater) Client() *retryablehttp.Client {
+	return u.client
+}
+
+func (u *Updater) Log() *slog.Logger {
+	return u.log
+}
+
+func (u *Updater) OutputRoot() string {
+	return u.outputRoot
+}
+
+// The metrics the updater records into, nil if there are none
+func (u *Updater) Metrics() *Metrics {
+	return u.metrics
+}
+
+// The store fetched versions are added to, nil if there is none
+func (u *Updater) Store() *Store {
+	return u.store
+}
+
+func (u *Updater) Source() Source {
+	return u.source
+}
+
+// The last version UpdateAPK brought game up to, empty if it never ran for game
+func (u *Updater) CurrentVersion(game *GameLink) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.currentVersions[game.Name]
+}
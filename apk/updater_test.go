@@ -0,0 +1,121 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Points every game at a fake versions listing
+type testSource string
+
+func (s testSource) Name() string {
+	return "test"
+}
+
+func (s testSource) VersionsURL(game *GameLink) string {
+	return string(s) + "/versions/%d"
+}
+
+func (s testSource) AppURL(game *GameLink) string {
+	return string(s) + "/app/current"
+}
+
+func TestUpdaterIsolation(t *testing.T) {
+	srv, _ := newFakeVersionsServer(t, 2, 3)
+
+	logger := NewLoggerTo(os.Stderr)
+	u := New(WithSource(testSource(srv.URL)), WithLogger(logger), WithConcurrency(1))
+	other := New()
+
+	if u.Client() == other.Client() || u.Client() == Default.Client() {
+		t.Error("every Updater should get its own HTTP client")
+	}
+	if Default.Client() != Client || Default.Log() != Log {
+		t.Error("Default should keep using the deprecated package level Client and Log")
+	}
+
+	vers, err := u.Versions(context.Background(), &ClashofClans)
+	if err != nil {
+		t.Fatalf("Versions() error = %v", err)
+	}
+	if len(vers) != 6 {
+		t.Errorf("Versions() returned %d versions, want 6", len(vers))
+	}
+}
+
+func TestImportDoesNotRegisterFlags(t *testing.T) {
+	if f := flag.CommandLine.Lookup("path"); f != nil {
+		t.Errorf("importing apk registered the -%s flag", f.Name)
+	}
+}
+
+func TestUpdateAPKAnyGame(t *testing.T) {
+	srv, _ := newFakeVersionsServer(t, 1, 2)
+	root := t.TempDir()
+	u := New(WithSource(testSource(srv.URL)), WithOutputRoot(root))
+
+	version, err := u.GetCurrentAPKVersion(context.Background(), &HayDay, false)
+	if err != nil {
+		t.Fatalf("GetCurrentAPKVersion() error = %v", err)
+	}
+	if version.String() != "1.2.0" {
+		t.Errorf("GetCurrentAPKVersion() = %s, want 1.2.0", version)
+	}
+
+	// apktool can't make sense of the fake APK, but the download should be named after the game
+	if _, err = u.UpdateAPK(context.Background(), &HayDay); err == nil {
+		t.Fatal("UpdateAPK() of a broken APK should fail")
+	}
+	if _, err = os.Stat(filepath.Join(root, "hayday-1.2.0.apk")); err != nil {
+		t.Errorf("downloaded APK isn't named after the game: %v", err)
+	}
+	if u.CurrentVersion(&HayDay) != "" {
+		t.Error("a failed update shouldn't count as being up to date")
+	}
+}
+
+func TestRegisterGame(t *testing.T) {
+	saved := append([]GameLink(nil), AllGameLinks...)
+	t.Cleanup(func() { AllGameLinks = saved })
+
+	added := RegisterGame(GameLink{Name: "Clash Heroes", Slugs: map[string]string{"uptodown": "clash-heroes-beta"}})
+	if got := Uptodown.VersionsURL(added); got != "https://clash-heroes-beta.en.uptodown.com/android/versions/%d" {
+		t.Errorf("VersionsURL() = %q", got)
+	}
+	if got := Uptodown.AppURL(&GameLink{Name: "Squad  Busters"}); got != "https://squad-busters.en.uptodown.com/android" {
+		t.Errorf("AppURL() without a slug = %q", got)
+	}
+	if game, ok := FindGame("clashheroes"); !ok || game.Name != "Clash Heroes" {
+		t.Error("a registered game can't be found by its slug")
+	}
+
+	n := len(AllGameLinks)
+	RegisterGame(GameLink{Name: "hay day", ValidDirectories: []string{"data"}})
+	if len(AllGameLinks) != n {
+		t.Error("registering a built-in game should replace it")
+	}
+	if game, _ := FindGame("Hay Day"); len(game.ValidDirectories) != 1 {
+		t.Errorf("Hay Day wasn't replaced: %+v", game)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrSignerMismatch  = errors.New("APK isn't signed by the expected certificate")
+	ErrPackageMismatch = errors.New("APK has an unexpected package name")
+)
+
+var (
+	signerDigestRe = regexp.MustCompile(`(?m)^Signer #\d+ certificate SHA-256 digest: ([0-9a-fA-F:]+)`)
+	manifestPkgRe  = regexp.MustCompile(`<manifest[^>]*\spackage="([^"]+)"`)
+)
+
+// Checks the APK's signing certificate against game.SignerSHA256 with apksigner.
+// Nothing is checked when the game has no fingerprint, and only a warning is logged when apksigner isn't installed
+func (u *Updater) VerifySigner(ctx context.Context, game *GameLink, apkPath string) error {
+	if game.SignerSHA256 == "" {
+		return nil
+	}
+	if _, err := exec.LookPath("apksigner"); err != nil {
+		u.log.Warn("apksigner isn't installed, not checking the signature", "game", game.Name, "file", apkPath)
+		return nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "apksigner", "verify", "--print-certs", apkPath)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: apksigner: %s", ErrSignerMismatch, strings.TrimSpace(stderr.String()))
+	}
+	return checkSigner(game, stdout.String())
+}
+
+// Matches apksigner's --print-certs output against the game's fingerprint, any of the signers may match
+func checkSigner(game *GameLink, certs string) error {
+	want := normalizeFingerprint(game.SignerSHA256)
+	matches := signerDigestRe.FindAllStringSubmatch(certs, -1)
+	for _, m := range matches {
+		if normalizeFingerprint(m[1]) == want {
+			return nil
+		}
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("%w: apksigner printed no certificates", ErrSignerMismatch)
+	}
+	return fmt.Errorf("%w: %s is signed by %s", ErrSignerMismatch, game.Name, matches[0][1])
+}
+
+func normalizeFingerprint(s string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(s))
+}
+
+// Checks the package name in a decompiled APK's manifest against game.Package, skipped when the game has none.
+// A manifest that's missing or names no package fails the check
+func VerifyPackage(game *GameLink, decompiledDir string) error {
+	if game.Package == "" {
+		return nil
+	}
+	manifest, err := os.ReadFile(filepath.Join(decompiledDir, "AndroidManifest.xml"))
+	if err != nil {
+		return fmt.Errorf("%w: can't read the manifest: %v", ErrPackageMismatch, err)
+	}
+	m := manifestPkgRe.FindSubmatch(manifest)
+	if m == nil {
+		return fmt.Errorf("%w: the manifest names no package", ErrPackageMismatch)
+	}
+	if got := string(m[1]); got != game.Package {
+		return fmt.Errorf("%w: expected %s, got %s", ErrPackageMismatch, game.Package, got)
+	}
+	return nil
+}
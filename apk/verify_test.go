@@ -0,0 +1,70 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSigner(t *testing.T) {
+	game := &GameLink{Name: "Squad Busters", SignerSHA256: "AB:CD:EF:01"}
+	certs := `Signer #1 certificate DN: CN=Supercell
+Signer #1 certificate SHA-256 digest: abcdef01
+Signer #1 certificate SHA-1 digest: 1234
+`
+	if err := checkSigner(game, certs); err != nil {
+		t.Errorf("checkSigner() = %v, want a match", err)
+	}
+	if err := checkSigner(game, "Signer #1 certificate SHA-256 digest: 00112233\n"); !errors.Is(err, ErrSignerMismatch) {
+		t.Errorf("checkSigner() = %v, want ErrSignerMismatch", err)
+	}
+	if err := checkSigner(game, ""); !errors.Is(err, ErrSignerMismatch) {
+		t.Errorf("checkSigner() without certificates = %v, want ErrSignerMismatch", err)
+	}
+}
+
+func TestVerifyPackage(t *testing.T) {
+	dir := t.TempDir()
+	manifest := `<?xml version="1.0" encoding="utf-8" standalone="no"?><manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.supercell.squad"></manifest>`
+	if err := os.WriteFile(filepath.Join(dir, "AndroidManifest.xml"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyPackage(&SquadBusters, dir); err != nil {
+		t.Errorf("VerifyPackage() = %v", err)
+	}
+	if err := VerifyPackage(&ClashofClans, dir); !errors.Is(err, ErrPackageMismatch) {
+		t.Errorf("VerifyPackage() = %v, want ErrPackageMismatch", err)
+	}
+	if err := VerifyPackage(&ClashofClans, t.TempDir()); !errors.Is(err, ErrPackageMismatch) {
+		t.Errorf("VerifyPackage() without a manifest = %v, want ErrPackageMismatch", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "AndroidManifest.xml"), []byte("<manifest></manifest>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyPackage(&SquadBusters, dir); !errors.Is(err, ErrPackageMismatch) {
+		t.Errorf("VerifyPackage() of a manifest without a package = %v, want ErrPackageMismatch", err)
+	}
+	if err := VerifyPackage(&GameLink{Name: "Unchecked"}, t.TempDir()); err != nil {
+		t.Errorf("VerifyPackage() of a game without a package = %v, want nil", err)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A game version such as 15.83.24 or 15.83.24-beta
+type Version struct {
+	Parts  []int
+	Suffix string
+}
+
+// What a pre-release suffix may contain, versions end up in file paths so separators are never allowed
+var versionSuffixRe = regexp.MustCompile(`^[A-Za-z0-9._]+$`)
+
+// Parses a version string, uptodown sometimes uses _ instead of . so both are accepted
+func ParseVersion(s string) (Version, error) {
+	raw := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if raw == "" {
+		return Version{}, fmt.Errorf("invalid version %q: empty", s)
+	}
+
+	var v Version
+	if i := strings.IndexAny(raw, "-+ "); i != -1 {
+		v.Suffix = strings.TrimLeft(raw[i:], "-+ ")
+		raw = raw[:i]
+		if !versionSuffixRe.MatchString(v.Suffix) || strings.Contains(v.Suffix, "..") {
+			return Version{}, fmt.Errorf("invalid version %q: bad suffix %q", s, v.Suffix)
+		}
+	}
+
+	for _, part := range strings.Split(strings.ReplaceAll(raw, "_", "."), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q: bad component %q", s, part)
+		}
+		v.Parts = append(v.Parts, n)
+	}
+	return v, nil
+}
+
+// Like ParseVersion but panics on error, only meant for constants
+func MustParseVersion(s string) Version {
+	v, err := ParseVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func (v Version) String() string {
+	parts := make([]string, len(v.Parts))
+	for i, n := range v.Parts {
+		parts[i] = strconv.Itoa(n)
+	}
+	s := strings.Join(parts, ".")
+	if v.Suffix != "" {
+		s += "-" + v.Suffix
+	}
+	return s
+}
+
+func (v Version) IsZero() bool {
+	return len(v.Parts) == 0 && v.Suffix == ""
+}
+
+// Returns -1, 0 or 1 if v is older than, the same as or newer than o.
+// Missing components count as 0 and a suffixed version is older than the plain one (15.83.24-beta < 15.83.24)
+func (v Version) Compare(o Version) int {
+	for i := 0; i < len(v.Parts) || i < len(o.Parts); i++ {
+		a, b := v.part(i), o.part(i)
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case v.Suffix == o.Suffix:
+		return 0
+	case v.Suffix == "":
+		return 1
+	case o.Suffix == "":
+		return -1
+	case v.Suffix < o.Suffix:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func (v Version) part(i int) int {
+	if i < len(v.Parts) {
+		return v.Parts[i]
+	}
+	return 0
+}
+
+// Reports whether every component of prefix matches v, so 15.83 has the prefix 15 and 15.83 but not 15.8
+func (v Version) HasPrefix(prefix Version) bool {
+	if len(prefix.Parts) > len(v.Parts) {
+		return false
+	}
+	for i, n := range prefix.Parts {
+		if v.Parts[i] != n {
+			return false
+		}
+	}
+	return prefix.Suffix == "" || prefix.Suffix == v.Suffix
+}
+
+type constraint struct {
+	op      string
+	version Version
+}
+
+func (c constraint) matches(v Version) bool {
+	cmp := v.Compare(c.version)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	case "<":
+		return cmp < 0
+	case "=", "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	default: // bare version
+		return v.HasPrefix(c.version)
+	}
+}
+
+// A set of version constraints, e.g. ">=15.0 <16" or "14 || >=15.83".
+// Space separated constraints must all match, || separates alternatives.
+// A bare version matches every version starting with it, so "15.83" matches 15.83.24
+type VersionRange struct {
+	raw  string
+	sets [][]constraint
+}
+
+func ParseVersionRange(s string) (VersionRange, error) {
+	r := VersionRange{raw: strings.TrimSpace(s)}
+	if r.raw == "" {
+		return r, fmt.Errorf("invalid version range %q: empty", s)
+	}
+
+	for _, alt := range strings.Split(r.raw, "||") {
+		var set []constraint
+		for _, field := range strings.Fields(joinOperators(alt)) {
+			op := strings.TrimRight(field, "0123456789._-+abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+			switch op {
+			case "", ">=", ">", "<=", "<", "=", "==", "!=":
+			default:
+				return VersionRange{}, fmt.Errorf("invalid version range %q: unknown operator %q", s, op)
+			}
+			v, err := ParseVersion(field[len(op):])
+			if err != nil {
+				return VersionRange{}, fmt.Errorf("invalid version range %q: %w", s, err)
+			}
+			set = append(set, constraint{op: op, version: v})
+		}
+		if len(set) == 0 {
+			return VersionRange{}, fmt.Errorf("invalid version range %q: empty alternative", s)
+		}
+		r.sets = append(r.sets, set)
+	}
+	return r, nil
+}
+
+// Glues operators to their version so ">= 15.0" parses the same as ">=15.0"
+func joinOperators(s string) string {
+	fields := strings.Fields(s)
+	var out []string
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if strings.Trim(f, "<>=!") == "" && i+1 < len(fields) {
+			f += fields[i+1]
+			i++
+		}
+		out = append(out, f)
+	}
+	return strings.Join(out, " ")
+}
+
+func (r VersionRange) Contains(v Version) bool {
+	for _, set := range r.sets {
+		ok := true
+		for _, c := range set {
+			if !c.matches(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r VersionRange) String() string {
+	return r.raw
+}
+
+// Sorts versions newest first
+func SortVersions(versions []VersionData) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Version.Compare(versions[j].Version) > 0
+	})
+}
+
+// Returns the versions inside r, keeping their order
+func FilterVersions(versions []VersionData, r VersionRange) []VersionData {
+	matched := make([]VersionData, 0)
+	for _, v := range versions {
+		if r.Contains(v.Version) {
+			matched = append(matched, v)
+		}
+	}
+	return matched
+}
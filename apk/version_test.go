@@ -0,0 +1,135 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Version
+		wantErr bool
+	}{
+		{name: "dotted", input: "15.83.24", want: Version{Parts: []int{15, 83, 24}}},
+		{name: "underscored", input: "15_83_24", want: Version{Parts: []int{15, 83, 24}}},
+		{name: "suffixed", input: "15.83.24-beta", want: Version{Parts: []int{15, 83, 24}, Suffix: "beta"}},
+		{name: "spaced suffix", input: " 14.426.4 beta ", want: Version{Parts: []int{14, 426, 4}, Suffix: "beta"}},
+		{name: "prefixed", input: "v2.1", want: Version{Parts: []int{2, 1}}},
+		{name: "empty", input: "", wantErr: true},
+		{name: "garbage", input: "15.x.1", wantErr: true},
+		{name: "trailing dot", input: "15.", wantErr: true},
+		{name: "slash in suffix", input: "1.0-x/../../../../tmp/evil", wantErr: true},
+		{name: "backslash in suffix", input: `1.0-x\..\evil`, wantErr: true},
+		{name: "dot dot suffix", input: "1.0-..", wantErr: true},
+		{name: "dangling dash", input: "1.0-", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseVersion(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseVersion(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseVersion(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "15.83.24", b: "15.83.24", want: 0},
+		{a: "15.83", b: "15.83.0", want: 0},
+		{a: "15.83.24", b: "15.83.3", want: 1},
+		{a: "14.426.4", b: "15.0.1", want: -1},
+		{a: "15.83.24-beta", b: "15.83.24", want: -1},
+		{a: "15.83.24-beta", b: "15.83.24-alpha", want: 1},
+		{a: "15.83.25-beta", b: "15.83.24", want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			if got := MustParseVersion(tt.a).Compare(MustParseVersion(tt.b)); got != tt.want {
+				t.Errorf("Compare() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionRange(t *testing.T) {
+	tests := []struct {
+		rng     string
+		in      []string
+		out     []string
+		wantErr bool
+	}{
+		{rng: ">=15.0 <16", in: []string{"15.0", "15.83.24", "15.99.1-beta"}, out: []string{"14.426.4", "16.0.0", "16"}},
+		{rng: ">= 15.0 < 16", in: []string{"15.83.24"}, out: []string{"16.1"}},
+		{rng: "15.83", in: []string{"15.83.24", "15.83"}, out: []string{"15.8.3", "15.830.1"}},
+		{rng: "14 || >=15.83", in: []string{"14.426.4", "15.83.1", "16.0"}, out: []string{"15.82.9"}},
+		{rng: "!=15.83.24", in: []string{"15.83.23"}, out: []string{"15.83.24"}},
+		{rng: "=>15", wantErr: true},
+		{rng: "", wantErr: true},
+		{rng: "15 ||", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rng, func(t *testing.T) {
+			r, err := ParseVersionRange(tt.rng)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseVersionRange(%q) error = %v, wantErr %v", tt.rng, err, tt.wantErr)
+			}
+			for _, v := range tt.in {
+				if !r.Contains(MustParseVersion(v)) {
+					t.Errorf("%q should contain %s", tt.rng, v)
+				}
+			}
+			for _, v := range tt.out {
+				if r.Contains(MustParseVersion(v)) {
+					t.Errorf("%q should not contain %s", tt.rng, v)
+				}
+			}
+		})
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	versions := []VersionData{
+		{Version: MustParseVersion("15.2.1")},
+		{Version: MustParseVersion("15.83.24-beta")},
+		{Version: MustParseVersion("14.426.4")},
+		{Version: MustParseVersion("15.83.24")},
+		{Version: MustParseVersion("15.10.0")},
+	}
+	SortVersions(versions)
+
+	var got []string
+	for _, v := range versions {
+		got = append(got, v.Version.String())
+	}
+	want := []string{"15.83.24", "15.83.24-beta", "15.10.0", "15.2.1", "14.426.4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SortVersions() = %v, want %v", got, want)
+	}
+}
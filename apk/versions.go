@@ -19,41 +19,114 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package apk
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/hashicorp/go-retryablehttp"
 	"golang.org/x/net/html"
 )
 
 type GameLink struct {
-	URL              string
+	URL              string // uptodown versions page, derived from Slugs or the name when empty
 	Name             string
 	ValidDirectories []string
+	Package          string            // Android package name, checked against the decompiled manifest when set
+	Slugs            map[string]string // the game's slug on each source, keyed by source name
+	SignerSHA256     string            // SHA-256 of the signing certificate, checked with apksigner when set
+}
+
+// The game's name squashed into something usable in file names, Clash of Clans becomes clashofclans
+func (g *GameLink) Slug() string {
+	return strings.ToLower(strings.ReplaceAll(g.Name, " ", ""))
+}
+
+// The game's slug on a source, e.g. clash-of-clans on uptodown. Defaults to the name in lowercase with dashes
+func (g *GameLink) SourceSlug(source string) string {
+	if slug, ok := g.Slugs[source]; ok && slug != "" {
+		return slug
+	}
+	return strings.ToLower(strings.Join(strings.Fields(g.Name), "-"))
+}
+
+// Adds a game to AllGameLinks, replacing the one with the same name or slug.
+// Returns the registered game, only valid until the next RegisterGame
+func RegisterGame(game GameLink) *GameLink {
+	if existing, ok := FindGame(game.Name); ok {
+		*existing = game
+		return existing
+	}
+	AllGameLinks = append(AllGameLinks, game)
+	return &AllGameLinks[len(AllGameLinks)-1]
+}
+
+// Looks a game up by its name or slug, ignoring case
+func FindGame(name string) (*GameLink, bool) {
+	for i := range AllGameLinks {
+		game := &AllGameLinks[i]
+		if strings.EqualFold(game.Name, name) || strings.EqualFold(game.Slug(), name) {
+			return game, true
+		}
+	}
+	return nil, false
 }
 
 type VersionData struct {
-	Version     string
-	URL         string
-	Date        string
-	DownloadURL string
+	Version Version
+	URL     string // uptodown page of this version, the download link is scraped from it by Resolve
+	Date    string
+}
+
+type cachedURL struct {
+	url     string
+	expires time.Time
+}
+
+// Returns the download link for this version, only fetching the version page if the link isn't cached or has expired
+func (v *VersionData) Resolve(ctx context.Context) (string, error) {
+	return Default.Resolve(ctx, v)
+}
+
+// Returns the download link for a version, only fetching the version page if the link isn't cached or has expired.
+// Uptodown links stop working after a while so they're only reused for DownloadURLTTL
+func (u *Updater) Resolve(ctx context.Context, v *VersionData) (string, error) {
+	u.mu.Lock()
+	cached, ok := u.downloadURLs[v.URL]
+	u.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.url, nil
+	}
+
+	url, err := u.GetDownloadURL(ctx, v.URL)
+	if err != nil {
+		return "", err
+	}
+
+	u.mu.Lock()
+	u.downloadURLs[v.URL] = cachedURL{url: url, expires: time.Now().Add(u.downloadURLTTL)}
+	u.mu.Unlock()
+	return url, nil
 }
 
 var (
-	ClashofClans = GameLink{URL: "https://clash-of-clans.en.uptodown.com/android/versions/%d", Name: "Clash of Clans", ValidDirectories: []string{"csv", "localization", "logic"}}
-	ClashRoyale  = GameLink{URL: "https://clash-royale.en.uptodown.com/android/versions/%d", Name: "Clash Royale"}
-	BrawlStars   = GameLink{URL: "https://brawl-stars.en.uptodown.com/android/versions/%d", Name: "Brawl Stars", ValidDirectories: []string{"csv_client", "csv_logic", "localization", "logic"}}
-	ClashMini    = GameLink{URL: "https://clash-mini.en.uptodown.com/android/versions/%d", Name: "Clash Mini"}
-	HayDay       = GameLink{URL: "https://hay-day.en.uptodown.com/android/versions/%d", Name: "Hay Day", ValidDirectories: []string{"data", "localization"}}
-	ClashQuest   = GameLink{URL: "https://clash-quest.en.uptodown.com/android/versions/%d", Name: "Clash Quest"}
-	BoomBeach    = GameLink{URL: "https://boom-beach.en.uptodown.com/android/versions/%d", Name: "Boom Beach"}
-	Everdale     = GameLink{URL: "https://everdale.en.uptodown.com/android/versions/%d", Name: "Everdale"}
-	HayDayPop    = GameLink{URL: "https://hay-day-pop.en.uptodown.com/android/versions/%d", Name: "Hay Day Pop"}
-	RushWars     = GameLink{URL: "https://rush-wars.en.uptodown.com/android/versions/%d", Name: "Rush Wars"}
+	ClashofClans = GameLink{URL: "https://clash-of-clans.en.uptodown.com/android/versions/%d", Name: "Clash of Clans", Package: "com.supercell.clashofclans", ValidDirectories: []string{"csv", "localization", "logic"}}
+	ClashRoyale  = GameLink{URL: "https://clash-royale.en.uptodown.com/android/versions/%d", Name: "Clash Royale", Package: "com.supercell.clashroyale"}
+	BrawlStars   = GameLink{URL: "https://brawl-stars.en.uptodown.com/android/versions/%d", Name: "Brawl Stars", Package: "com.supercell.brawlstars", ValidDirectories: []string{"csv_client", "csv_logic", "localization", "logic"}}
+	ClashMini    = GameLink{URL: "https://clash-mini.en.uptodown.com/android/versions/%d", Name: "Clash Mini", Package: "com.supercell.clashmini"}
+	HayDay       = GameLink{URL: "https://hay-day.en.uptodown.com/android/versions/%d", Name: "Hay Day", Package: "com.supercell.hayday", ValidDirectories: []string{"data", "localization"}}
+	ClashQuest   = GameLink{URL: "https://clash-quest.en.uptodown.com/android/versions/%d", Name: "Clash Quest", Package: "com.supercell.clashquest"}
+	BoomBeach    = GameLink{URL: "https://boom-beach.en.uptodown.com/android/versions/%d", Name: "Boom Beach", Package: "com.supercell.boombeach"}
+	Everdale     = GameLink{URL: "https://everdale.en.uptodown.com/android/versions/%d", Name: "Everdale", Package: "com.supercell.everdale"}
+	HayDayPop    = GameLink{URL: "https://hay-day-pop.en.uptodown.com/android/versions/%d", Name: "Hay Day Pop", Package: "com.supercell.haydaypop"}
+	RushWars     = GameLink{URL: "https://rush-wars.en.uptodown.com/android/versions/%d", Name: "Rush Wars", Package: "com.supercell.rushwars"}
+	SquadBusters = GameLink{URL: "https://squad-busters.en.uptodown.com/android/versions/%d", Name: "Squad Busters", Package: "com.supercell.squad"}
 
 	AllGameLinks = []GameLink{
 		ClashofClans,
@@ -66,59 +139,172 @@ var (
 		Everdale,
 		HayDayPop,
 		RushWars,
+		SquadBusters,
 	}
 
 	ErrLastPage = fmt.Errorf("End of the Line!")
 )
 
+const (
+	// How many versions pages are fetched at once unless overridden with WithConcurrency
+	MaxConcurrentPages = 4
+	// Minimum time between two versions page requests unless overridden with WithPageInterval
+	PageInterval = 100 * time.Millisecond
+	// How long a resolved download link is reused
+	DownloadURLTTL = 10 * time.Minute
+)
+
+// Fetches every versions page of a game, at most MaxConcurrentPages at a time and one every PageInterval.
+// Versions are returned in page order no matter which page finished first
 func GetAllVersions(gamelink string) ([]VersionData, error) {
-	var page int = 0
-	var wg sync.WaitGroup
-	keepGoing := true
-	versions := make([]VersionData, 0)
-	for {
-		if !keepGoing {
+	return GetAllVersionsContext(context.Background(), gamelink)
+}
+
+// Like GetAllVersions but gives up as soon as ctx is done
+func GetAllVersionsContext(ctx context.Context, gamelink string) ([]VersionData, error) {
+	return Default.GetAllVersions(ctx, gamelink)
+}
+
+// Fetches every versions page of gamelink, see GetAllVersions
+func (u *Updater) GetAllVersions(ctx context.Context, gamelink string) ([]VersionData, error) {
+	return paginate(ctx, u.concurrency, NewRateLimiter(u.pageInterval), func(ctx context.Context, page int) ([]VersionData, error) {
+		return u.GetVersions(ctx, gamelink, page)
+	})
+}
+
+// Fetches every version of game from the updater's source
+func (u *Updater) Versions(ctx context.Context, game *GameLink) ([]VersionData, error) {
+	return u.GetAllVersions(ctx, u.source.VersionsURL(game))
+}
+
+// Calls fetch for pages 1, 2, 3... until one returns ErrLastPage, the pages past it are cancelled and dropped
+func paginate(ctx context.Context, concurrency int, limiter *RateLimiter, fetch func(ctx context.Context, page int) ([]VersionData, error)) ([]VersionData, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		lastPage = math.MaxInt // first page past the end
+		errPage  = math.MaxInt // first page that failed
+		errs     = make(map[int]error)
+		results  = make(map[int][]VersionData)
+		inflight = make(map[int]context.CancelFunc)
+		sem      = make(chan struct{}, concurrency)
+	)
+
+	// stopped reports whether page is past the end or past a failure, mu must be held
+	stopped := func(page int) bool {
+		return page >= lastPage || page > errPage
+	}
+
+	for page := 1; ; page++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			<-sem
 			break
 		}
 
-		time.Sleep(time.Millisecond * 100)
+		mu.Lock()
+		if stopped(page) {
+			mu.Unlock()
+			<-sem
+			break
+		}
+		pageCtx, pageCancel := context.WithCancel(ctx)
+		inflight[page] = pageCancel
+		mu.Unlock()
+
 		wg.Add(1)
 		go func(page int) {
 			defer wg.Done()
-			vers, err := GetVersions(gamelink, page)
-			if err != nil && err != ErrLastPage {
-				Log.Error(err)
-				keepGoing = false
+			defer func() { <-sem }()
+
+			vers, err := fetch(pageCtx, page)
+
+			mu.Lock()
+			defer mu.Unlock()
+			inflight[page]()
+			delete(inflight, page)
+			switch {
+			case errors.Is(err, ErrLastPage):
+				if page < lastPage {
+					lastPage = page
+				}
+			case err != nil:
+				errs[page] = err
+				if page < errPage {
+					errPage = page
+				}
+			default:
+				results[page] = vers
+				return
 			}
-			if err == ErrLastPage {
-				keepGoing = false
+			for p, cancelPage := range inflight {
+				if stopped(p) {
+					cancelPage()
+				}
 			}
-			versions = append(versions, vers...)
 		}(page)
-		page++
 	}
 	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if errPage < lastPage {
+		return nil, fmt.Errorf("fetching versions page %d: %w", errPage, errs[errPage])
+	}
+
+	versions := make([]VersionData, 0)
+	for page := 1; page < lastPage; page++ {
+		versions = append(versions, results[page]...)
+	}
 	return versions, nil
 }
 
 func GetVersions(gamelink string, page int) ([]VersionData, error) {
-	Log.Info(fmt.Sprintf(gamelink, page))
-	resp, err := Client.Get(fmt.Sprintf(gamelink, page))
+	return GetVersionsContext(context.Background(), gamelink, page)
+}
+
+// Like GetVersions but the request is cancelled with ctx
+func GetVersionsContext(ctx context.Context, gamelink string, page int) ([]VersionData, error) {
+	return Default.GetVersions(ctx, gamelink, page)
+}
+
+// Fetches a single versions page, ErrLastPage is returned once page is past the end
+func (u *Updater) GetVersions(ctx context.Context, gamelink string, page int) ([]VersionData, error) {
+	url := fmt.Sprintf(gamelink, page)
+	u.log.Info("Fetching versions page", "url", url, "page", page)
+	req, err := retryablehttp.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
 	if err != nil {
-		Log.Error(err)
+		u.log.Error("Fetching versions page failed", "url", url, "err", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	bytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		Log.Error(err)
+		u.log.Error("Reading versions page failed", "url", url, "err", err)
 		return nil, err
 	}
 
 	n, err := html.Parse(strings.NewReader(string(bytes)))
 	if err != nil {
-		Log.Error(err)
+		u.log.Error("Parsing versions page failed", "url", url, "err", err)
 		return nil, err
 	}
 
@@ -128,7 +314,7 @@ func GetVersions(gamelink string, page int) ([]VersionData, error) {
 	query.Find("span.page-link.active").Each(func(i int, s *goquery.Selection) {
 		currentPage, err = strconv.Atoi(s.Text())
 		if err != nil {
-			Log.Error(err)
+			u.log.Error("Parsing the page number failed", "url", url, "err", err)
 			return
 		}
 	})
@@ -139,23 +325,16 @@ func GetVersions(gamelink string, page int) ([]VersionData, error) {
 	vers := make([]VersionData, 0)
 	query.Find("div").Each(func(i int, s *goquery.Selection) {
 		if val, ok := s.Attr("data-url"); ok {
+			version, err := ParseVersion(s.Contents().Not("span").Text())
+			if err != nil {
+				u.log.Warn("Skipping version", "url", val, "err", err)
+				return
+			}
 
-			ch := make(chan string)
-			go func(val string) {
-				url, err := GetDownloadURL(val)
-				if err != nil {
-					Log.Error(err)
-					return
-				}
-				ch <- url
-			}(val)
-
-			_, _ = GetDownloadURL(val)
 			vers = append(vers, VersionData{
-				Version:     strings.ReplaceAll(strings.TrimSpace(s.Contents().Not("span").Text()), "_", "."),
-				URL:         val,
-				Date:        s.Find("span").Text(),
-				DownloadURL: <-ch,
+				Version: version,
+				URL:     val,
+				Date:    s.Find("span").Text(),
 			})
 		}
 	})
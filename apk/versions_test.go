@@ -19,49 +19,344 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package apk
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"text/template"
+	"time"
 )
 
-func TestGetAllVersions(t *testing.T) {
-	t.Run("Versions", func(t *testing.T) {
-		vers, err := GetAllVersions(ClashofClans.URL)
+// Serves a fake uptodown versions listing with the given number of pages, each holding perPage versions
+// numbered from newest (page 1) to oldest
+func newFakeVersionsServer(t *testing.T, pages, perPage int) (*httptest.Server, *int64) {
+	t.Helper()
+	var hits int64
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/versions/"):
+			page, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/versions/"))
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			active := page
+			if active > pages {
+				active = pages // uptodown keeps showing the last page
+			}
+			fmt.Fprintf(w, `<html><body><span class="page-link active">%d</span>`, active)
+			for i := 0; i < perPage; i++ {
+				n := (pages-active)*perPage + perPage - i
+				fmt.Fprintf(w, `<div data-url="%s/app/%d">1.%d.0 <span>Jan %d, 2022</span></div>`, srv.URL, n, n, n)
+			}
+			fmt.Fprint(w, `</body></html>`)
+		case strings.HasPrefix(r.URL.Path, "/app/"):
+			fmt.Fprint(w, `<html><head><script type="application/ld+json">`)
+			fmt.Fprintf(w, `{"mainEntity":{"softwareVersion":"1.%d.0"}}</script></head>`, pages*perPage)
+			fmt.Fprintf(w, `<body><a class="button download" href="%s/dl%s">Download</a></body></html>`, srv.URL, r.URL.Path)
+		case strings.HasPrefix(r.URL.Path, "/dl/"):
+			w.Header().Set("Content-Type", "application/vnd.android.package-archive")
+			fmt.Fprint(w, "PK\x03\x04 not really an apk")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestGetAllVersionsPagination(t *testing.T) {
+	srv, hits := newFakeVersionsServer(t, 3, 2)
+
+	vers, err := GetAllVersions(srv.URL + "/versions/%d")
+	if err != nil {
+		t.Fatalf("GetAllVersions() error = %v", err)
+	}
+
+	var got []string
+	for _, v := range vers {
+		got = append(got, v.Version.String())
+	}
+	want := "1.6.0 1.5.0 1.4.0 1.3.0 1.2.0 1.1.0"
+	if strings.Join(got, " ") != want {
+		t.Errorf("GetAllVersions() = %v, want %s", got, want)
+	}
+	// Only the versions pages, download links are resolved lazily
+	if n := atomic.LoadInt64(hits); n > int64(4+MaxConcurrentPages) {
+		t.Errorf("listing made %d requests, want at most %d", n, 4+MaxConcurrentPages)
+	}
+}
+
+func TestVersionDataResolve(t *testing.T) {
+	srv, hits := newFakeVersionsServer(t, 1, 1)
+	u := New()
+
+	v := VersionData{URL: srv.URL + "/app/42"}
+	for i := 0; i < 3; i++ {
+		url, err := u.Resolve(context.Background(), &v)
 		if err != nil {
-			Log.Errorf("Versions() error = %v", err)
-			return
+			t.Fatalf("Resolve() error = %v", err)
 		}
-		for _, v := range vers {
-			Log.Infof("%+v", v)
+		if url != srv.URL+"/dl/app/42" {
+			t.Errorf("Resolve() = %s, want %s", url, srv.URL+"/dl/app/42")
 		}
-	})
+	}
+	if n := atomic.LoadInt64(hits); n != 1 {
+		t.Errorf("Resolve() made %d requests, want 1 thanks to the cache", n)
+	}
+
+	u.downloadURLTTL = -time.Second
+	other := VersionData{URL: srv.URL + "/app/43"}
+	_, _ = u.Resolve(context.Background(), &other)
+	_, _ = u.Resolve(context.Background(), &other)
+	if n := atomic.LoadInt64(hits); n != 3 {
+		t.Errorf("expired links should be fetched again, got %d requests, want 3", n)
+	}
 }
 
-func TestGetVersions(t *testing.T) {
-	type args struct {
-		page int
-	}
-	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
-	}{
-		{name: "1", args: args{page: 1}, wantErr: false},
-		{name: "2", args: args{page: 2}, wantErr: false},
-		{name: "3", args: args{page: 3}, wantErr: false},
-		{name: "4", args: args{page: 4}, wantErr: false},
-		{name: "5", args: args{page: 5}, wantErr: false},
-		{name: "6", args: args{page: 6}, wantErr: false},
-		{name: "7", args: args{page: 7}, wantErr: false},
-		{name: "8", args: args{page: 8}, wantErr: false},
-		{name: "9", args: args{page: 9}, wantErr: false},
-		{name: "10", args: args{page: 10}, wantErr: true},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			_, err := GetVersions(ClashofClans.URL, tt.args.page)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("Version() error = %v, wantErr %v", err, tt.wantErr)
+func TestPaginateOrderingAndBounds(t *testing.T) {
+	const last = 7
+	var running, maxRunning int64
+	fetch := func(ctx context.Context, page int) ([]VersionData, error) {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		if page >= last {
+			return nil, ErrLastPage
+		}
+		// Later pages finish first to shake out ordering bugs
+		select {
+		case <-time.After(time.Duration(last-page) * 5 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return []VersionData{{URL: strconv.Itoa(page)}}, nil
+	}
+
+	vers, err := paginate(context.Background(), 3, nil, fetch)
+	if err != nil {
+		t.Fatalf("paginate() error = %v", err)
+	}
+	var got []string
+	for _, v := range vers {
+		got = append(got, v.URL)
+	}
+	if strings.Join(got, ",") != "1,2,3,4,5,6" {
+		t.Errorf("paginate() order = %v", got)
+	}
+	if maxRunning > 3 {
+		t.Errorf("paginate() ran %d fetches at once, limit was 3", maxRunning)
+	}
+}
+
+func TestPaginateStopsAtLastPage(t *testing.T) {
+	var mu sync.Mutex
+	fetched := make(map[int]bool)
+	cancelled := int64(0)
+	fetch := func(ctx context.Context, page int) ([]VersionData, error) {
+		mu.Lock()
+		fetched[page] = true
+		mu.Unlock()
+		if page == 2 {
+			return nil, ErrLastPage
+		}
+		if page > 2 {
+			<-ctx.Done() // pages past the end hang until cancelled
+			atomic.AddInt64(&cancelled, 1)
+			return nil, ctx.Err()
+		}
+		return []VersionData{{URL: strconv.Itoa(page)}}, nil
+	}
+
+	vers, err := paginate(context.Background(), 4, nil, fetch)
+	if err != nil {
+		t.Fatalf("paginate() error = %v", err)
+	}
+	if len(vers) != 1 || vers[0].URL != "1" {
+		t.Errorf("paginate() = %+v, want only page 1", vers)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for page := range fetched {
+		if page > 5 {
+			t.Errorf("paginate() fetched page %d, past the end plus the concurrency limit", page)
+		}
+	}
+	if int(cancelled) != len(fetched)-2 {
+		t.Errorf("%d pages past the end were cancelled, want %d", cancelled, len(fetched)-2)
+	}
+}
+
+func TestPaginateError(t *testing.T) {
+	boom := errors.New("boom")
+	fetch := func(ctx context.Context, page int) ([]VersionData, error) {
+		switch {
+		case page == 2:
+			return nil, boom
+		case page > 4:
+			return nil, ErrLastPage
+		}
+		return []VersionData{{URL: strconv.Itoa(page)}}, nil
+	}
+
+	if _, err := paginate(context.Background(), 2, nil, fetch); !errors.Is(err, boom) {
+		t.Errorf("paginate() error = %v, want %v", err, boom)
+	}
+}
+
+func TestPaginateRateLimit(t *testing.T) {
+	fetch := func(ctx context.Context, page int) ([]VersionData, error) {
+		if page == 4 {
+			return nil, ErrLastPage
+		}
+		return nil, nil
+	}
+
+	start := time.Now()
+	if _, err := paginate(context.Background(), 4, NewRateLimiter(20*time.Millisecond), fetch); err != nil {
+		t.Fatalf("paginate() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("4 pages took %s, want at least 60ms with a 20ms interval", elapsed)
+	}
+}
+
+func TestPaginateCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fetch := func(ctx context.Context, page int) ([]VersionData, error) {
+		if page == 2 {
+			cancel()
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	if _, err := paginate(ctx, 2, nil, fetch); !errors.Is(err, context.Canceled) {
+		t.Errorf("paginate() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+// Serves the pages in testdata/uptodown the way uptodown lays them out, with {{.URL}} replaced by the server's URL.
+// Like the real site, a versions page past the end shows the last page again
+func newUptodownServer(t *testing.T) (*httptest.Server, *GameLink) {
+	t.Helper()
+	pages, err := template.ParseGlob(filepath.Join("testdata", "uptodown", "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastPage := 0
+	for pages.Lookup(fmt.Sprintf("versions-%d.html", lastPage+1)) != nil {
+		lastPage++
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := ""
+		switch {
+		case r.URL.Path == "/android":
+			page = "app.html"
+		case strings.HasPrefix(r.URL.Path, "/android/versions/"):
+			n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/android/versions/"))
+			if err != nil || n < 1 {
+				http.NotFound(w, r)
 				return
 			}
-		})
+			if n > lastPage {
+				n = lastPage
+			}
+			page = fmt.Sprintf("versions-%d.html", n)
+		case strings.HasPrefix(r.URL.Path, "/android/download/"):
+			page = "download-" + strings.TrimPrefix(r.URL.Path, "/android/download/") + ".html"
+		case strings.HasPrefix(r.URL.Path, "/dwn/"):
+			w.Header().Set("Content-Type", "application/vnd.android.package-archive")
+			http.ServeFile(w, r, filepath.Join("testdata", "uptodown", "clash-of-clans.apk"))
+			return
+		}
+		if pages.Lookup(page) == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = pages.ExecuteTemplate(w, page, struct{ URL string }{srv.URL})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &GameLink{Name: "Clash of Clans", URL: srv.URL + "/android/versions/%d"}
+}
+
+func TestGetVersions(t *testing.T) {
+	srv, game := newUptodownServer(t)
+
+	vers, err := GetVersions(game.URL, 1)
+	if err != nil {
+		t.Fatalf("GetVersions() error = %v", err)
+	}
+	// The Beta entry isn't a version and is skipped
+	want := []VersionData{
+		{Version: MustParseVersion("15.352.8"), URL: srv.URL + "/android/download/101", Date: "Mar 28, 2023"},
+		{Version: MustParseVersion("15.297.24"), URL: srv.URL + "/android/download/102", Date: "Mar 1, 2023"},
+		{Version: MustParseVersion("15.297.22"), URL: srv.URL + "/android/download/103", Date: "Feb 21, 2023"},
+	}
+	if !reflect.DeepEqual(vers, want) {
+		t.Errorf("GetVersions() = %+v, want %+v", vers, want)
+	}
+
+	if vers, err = GetVersions(game.URL, 3); err != nil || len(vers) != 2 {
+		t.Errorf("GetVersions() of the last page = %d versions, %v, want 2", len(vers), err)
+	}
+	if _, err = GetVersions(game.URL, 4); !errors.Is(err, ErrLastPage) {
+		t.Errorf("GetVersions() past the end error = %v, want %v", err, ErrLastPage)
+	}
+}
+
+func TestGetAllVersions(t *testing.T) {
+	_, game := newUptodownServer(t)
+
+	vers, err := GetAllVersions(game.URL)
+	if err != nil {
+		t.Fatalf("GetAllVersions() error = %v", err)
+	}
+	var got []string
+	for _, v := range vers {
+		got = append(got, v.Version.String())
+	}
+	want := "15.352.8 15.297.24 15.297.22 15.292.17 15.272.23 15.83.24 15.83.22 15.0.4"
+	if strings.Join(got, " ") != want {
+		t.Errorf("GetAllVersions() = %v, want %s", got, want)
+	}
+}
+
+func TestGetCurrentAPKVersion(t *testing.T) {
+	_, game := newUptodownServer(t)
+
+	version, err := GetCurrentAPKVersion(game, false)
+	if err != nil || version != "15.352.8" {
+		t.Errorf("GetCurrentAPKVersion() = %s, %v, want 15.352.8", version, err)
+	}
+}
+
+func TestGetDownloadURL(t *testing.T) {
+	srv, _ := newUptodownServer(t)
+
+	url, err := GetDownloadURL(srv.URL + "/android/download/104")
+	if want := srv.URL + "/dwn/104/clash-of-clans-15.292.17.apk"; err != nil || url != want {
+		t.Errorf("GetDownloadURL() = %s, %v, want %s", url, err, want)
+	}
+	if _, err = GetDownloadURL(srv.URL + "/android/download/gone"); err == nil {
+		t.Error("GetDownloadURL() of a page without a download button should fail")
 	}
 }
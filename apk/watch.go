@@ -0,0 +1,245 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The last version seen per game, kept on disk so a restarted watcher doesn't fetch everything again
+type WatchState struct {
+	mu       sync.Mutex
+	path     string
+	Versions map[string]string    `json:"versions"`
+	Seen     map[string]time.Time `json:"seen,omitempty"` // when each version was first seen
+}
+
+// Loads the state file, a missing file is an empty state
+func LoadWatchState(path string) (*WatchState, error) {
+	state := &WatchState{path: path, Versions: make(map[string]string), Seen: make(map[string]time.Time)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Versions == nil {
+		state.Versions = make(map[string]string)
+	}
+	if state.Seen == nil {
+		state.Seen = make(map[string]time.Time)
+	}
+	return state, nil
+}
+
+func (s *WatchState) Get(game string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.Versions[game]
+	return v, ok
+}
+
+// When the recorded version of game was first seen, zero for states written before this was tracked
+func (s *WatchState) SeenAt(game string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Seen[game]
+}
+
+// Records the version and writes the state file right away
+func (s *WatchState) Set(game, version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Versions[game] != version || s.Seen[game].IsZero() {
+		s.Seen[game] = time.Now()
+	}
+	s.Versions[game] = version
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Where the watch state lives unless told otherwise, e.g. ~/.config/apk-updater/watch-state.json
+func DefaultWatchStateFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "apk-updater", "watch-state.json")
+}
+
+// Polls games for new versions and fetches them as they come out
+type Watcher struct {
+	Updater  *Updater
+	Games    []*GameLink
+	State    *WatchState
+	Interval time.Duration
+	Jitter   time.Duration // every wait is randomly stretched or shrunk by up to this much
+	// Fetch games seen for the first time, otherwise their current version is only recorded
+	FetchInitial bool
+	// Told about every fetched version, optional
+	Notifier Notifier
+
+	rng *rand.Rand
+}
+
+// Checks every game, then again every Interval until ctx is done.
+// Returns nil when stopped through ctx, a fetch that was cut short is cleaned up by the pipeline
+func (w *Watcher) Run(ctx context.Context) error {
+	w.seedMetrics()
+	for {
+		w.CheckAll(ctx)
+
+		wait := w.nextWait()
+		w.Updater.log.Info("Next check", "in", wait.Round(time.Second))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			w.Updater.log.Info("Stopping watcher")
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+func (w *Watcher) nextWait() time.Duration {
+	wait := w.Interval
+	if w.Jitter > 0 {
+		if w.rng == nil {
+			w.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		wait += time.Duration(w.rng.Int63n(int64(2*w.Jitter))) - w.Jitter
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// Checks each game once, a failing game is logged and retried on the next round
+func (w *Watcher) CheckAll(ctx context.Context) {
+	for _, game := range w.Games {
+		if ctx.Err() != nil {
+			return
+		}
+		_, err := w.Check(ctx, game)
+		if ctx.Err() != nil {
+			return
+		}
+		w.Updater.metrics.CheckDone(game.Name, err)
+		if err != nil {
+			w.Updater.log.Error("Checking failed", "game", game.Name, "err", err)
+		}
+	}
+}
+
+// Looks for a new version of game and fetches it, the returned release is nil if nothing was fetched
+func (w *Watcher) Check(ctx context.Context, game *GameLink) (*Release, error) {
+	latest, err := w.Updater.Latest(ctx, game)
+	if err != nil {
+		return nil, err
+	}
+
+	seen, ok := w.State.Get(game.Name)
+	if ok {
+		if previous, err := ParseVersion(seen); err == nil && latest.Version.Compare(previous) <= 0 {
+			w.Updater.log.Info("Up to date", "game", game.Name, "version", seen)
+			return nil, nil
+		}
+	} else if !w.FetchInitial {
+		w.Updater.log.Info("First time seeing game, recording its version without fetching it", "game", game.Name, "version", latest.Version)
+		return nil, w.record(game, latest.Version.String())
+	}
+
+	w.Updater.log.Info("New version available", "game", game.Name, "version", latest.Version)
+	release, err := w.Updater.Fetch(ctx, game, *latest)
+	if err != nil {
+		return nil, err
+	}
+	w.Updater.metrics.NewVersion(game.Name)
+	if err = w.record(game, latest.Version.String()); err != nil {
+		return release, err
+	}
+
+	if w.Notifier != nil {
+		if err = w.Notifier.Notify(ctx, w.notification(release, seen)); err != nil {
+			w.Updater.log.Error("Notifying failed", "game", game.Name, "version", latest.Version, "err", err)
+		}
+	}
+	return release, nil
+}
+
+// Saves the version of game in the state and the last seen gauge
+func (w *Watcher) record(game *GameLink, version string) error {
+	err := w.State.Set(game.Name, version)
+	w.Updater.metrics.VersionSeen(game.Name, version, w.State.SeenAt(game.Name))
+	return err
+}
+
+// Sets the last seen gauge of every watched game already in the state, so it survives restarts
+func (w *Watcher) seedMetrics() {
+	for _, game := range w.Games {
+		if version, ok := w.State.Get(game.Name); ok {
+			if seen := w.State.SeenAt(game.Name); !seen.IsZero() {
+				w.Updater.metrics.VersionSeen(game.Name, version, seen)
+			}
+		}
+	}
+}
+
+// Builds the notification for a release, comparing its assets with the previous version's if they're still around
+func (w *Watcher) notification(release *Release, previous string) *Notification {
+	n := &Notification{
+		Game:        release.Game.Name,
+		OldVersion:  previous,
+		NewVersion:  release.Version.Version.String(),
+		ReleaseDate: release.Version.Date,
+	}
+	if previous == "" {
+		return n
+	}
+	oldAssets := w.Updater.AssetsPath(release.Game, previous)
+	if _, err := os.Stat(oldAssets); err != nil {
+		return n
+	}
+	changes, err := DiffAssetTrees(oldAssets, release.AssetsPath)
+	if err != nil {
+		w.Updater.log.Warn("Comparing assets failed", "game", release.Game.Name, "previous", previous, "err", err)
+		return n
+	}
+	n.Changes = changes
+	return n
+}
@@ -0,0 +1,106 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package apk
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchStatePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "state.json")
+	state, err := LoadWatchState(path)
+	if err != nil {
+		t.Fatalf("LoadWatchState() on a missing file error = %v", err)
+	}
+	if err = state.Set("Clash of Clans", "15.83.24"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	reloaded, err := LoadWatchState(path)
+	if err != nil {
+		t.Fatalf("LoadWatchState() error = %v", err)
+	}
+	if v, ok := reloaded.Get("Clash of Clans"); !ok || v != "15.83.24" {
+		t.Errorf("Get() = %q, %v, want 15.83.24, true", v, ok)
+	}
+}
+
+func TestWatcherCheck(t *testing.T) {
+	srv, _ := newFakeVersionsServer(t, 1, 2)
+	state, _ := LoadWatchState(filepath.Join(t.TempDir(), "state.json"))
+	w := &Watcher{
+		Updater: New(WithSource(testSource(srv.URL)), WithOutputRoot(t.TempDir())),
+		State:   state,
+	}
+	game := &ClashofClans
+	ctx := context.Background()
+
+	// First sight is only recorded
+	if release, err := w.Check(ctx, game); err != nil || release != nil {
+		t.Fatalf("first Check() = %v, %v, want nothing fetched", release, err)
+	}
+	if v, _ := state.Get(game.Name); v != "1.2.0" {
+		t.Fatalf("first Check() recorded %q, want 1.2.0", v)
+	}
+
+	// Same version again is a no-op
+	if release, err := w.Check(ctx, game); err != nil || release != nil {
+		t.Fatalf("second Check() = %v, %v, want nothing fetched", release, err)
+	}
+
+	// A newer version is fetched, the fake APK can't be decompiled so the state must not move
+	_ = state.Set(game.Name, "1.1.0")
+	if _, err := w.Check(ctx, game); err == nil {
+		t.Fatal("Check() of a broken APK should fail")
+	}
+	if v, _ := state.Get(game.Name); v != "1.1.0" {
+		t.Errorf("failed fetch moved the state to %q", v)
+	}
+}
+
+func TestWatcherRunStops(t *testing.T) {
+	srv, _ := newFakeVersionsServer(t, 1, 1)
+	state, _ := LoadWatchState(filepath.Join(t.TempDir(), "state.json"))
+	w := &Watcher{
+		Updater:  New(WithSource(testSource(srv.URL))),
+		Games:    []*GameLink{&ClashofClans},
+		State:    state,
+		Interval: time.Hour,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v, want nil on shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() didn't stop once its context was done")
+	}
+	if _, ok := state.Get(ClashofClans.Name); !ok {
+		t.Error("Run() should check every game before waiting")
+	}
+}
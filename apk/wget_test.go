@@ -19,18 +19,91 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package apk
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestWget(t *testing.T) {
-	fmt.Println("begin")
-	vers, err := GetAllVersions(ClashofClans.URL)
+	_, game := newUptodownServer(t)
+	want, err := os.ReadFile(filepath.Join("testdata", "uptodown", "clash-of-clans.apk"))
 	if err != nil {
-		Log.Errorf("Versions() error = %v", err)
-		return
+		t.Fatal(err)
+	}
+
+	vers, err := GetVersions(game.URL, 2)
+	if err != nil {
+		t.Fatalf("GetVersions() error = %v", err)
+	}
+	url, err := vers[0].Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+
+	fp := filepath.Join(t.TempDir(), "test.apk")
+	if got, err := WgetAPK(game, url, vers[0].Version.String(), fp); err != nil || got != fp {
+		t.Fatalf("WgetAPK() = %s, %v, want %s", got, err, fp)
+	}
+	if got, _ := os.ReadFile(fp); !bytes.Equal(got, want) {
+		t.Errorf("WgetAPK() wrote %q, want %q", got, want)
+	}
+
+	// Without a path the APK is named after the game and version in the output root
+	out := t.TempDir()
+	u := New(WithOutputRoot(out), WithProgress(NoProgress{}))
+	got, err := u.WgetAPK(context.Background(), game, url, "15.292.17", "")
+	if want := filepath.Join(out, "clashofclans-15.292.17.apk"); err != nil || got != want {
+		t.Errorf("WgetAPK() = %s, %v, want %s", got, err, want)
+	}
+}
+
+func TestWgetAPKContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1048576")
+		_, _ = w.Write(make([]byte, 1024))
+		w.(http.Flusher).Flush()
+		select { // stall mid download
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	fp := filepath.Join(t.TempDir(), "partial.apk")
+	if _, err := WgetAPKContext(ctx, &ClashofClans, srv.URL, "1.0.0", fp); err == nil {
+		t.Fatal("WgetAPKContext() should fail once the context is done")
+	}
+	if _, err := os.Stat(fp); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial download %s was left behind (stat error = %v)", fp, err)
+	}
+}
+
+func TestWalkAndDecompressAssetsContextCancel(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "apk", "assets", "csv"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "apk", "assets", "csv", "a.csv"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	out := filepath.Join(dir, "out")
+	if _, err := WalkAndDecompressAssetsContext(ctx, []string{"csv"}, filepath.Join(dir, "apk"), out); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WalkAndDecompressAssetsContext() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(out); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial output %s was left behind (stat error = %v)", out, err)
 	}
-	// log first url
-	Log.Info(vers[0].DownloadURL)
-	_, _ = WgetAPK(&ClashofClans, vers[0].DownloadURL, "", "test.apk")
 }
@@ -0,0 +1,95 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/amaanq/apk-updater/apk"
+	"github.com/spf13/cobra"
+)
+
+var archiveRepo string
+var archiveGame string
+var archiveVersion string
+var archiveKeep bool
+
+// archiveCmd represents the archive command
+var archiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "Commit decompressed assets into a git repository, one commit and tag per version",
+	Long: `Archive fetches a version, copies its decompressed assets into the game's folder of a git repository, commits and tags it (e.g. clashofclans-15.83.24) so balance changes can be followed with git log -p.
+
+Pointed at an empty repository every published version is archived, oldest first. Otherwise only the newest version is archived, or every version in the --version range.
+Versions that already have a tag are skipped, so an interrupted backfill can simply be rerun.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var game *apk.GameLink
+		var err error
+		if archiveGame != "" {
+			var ok bool
+			if game, ok = apk.FindGame(archiveGame); !ok {
+				return fmt.Errorf("unknown game %q", archiveGame)
+			}
+		} else if game, err = selectGame("Which game do you want to archive"); err != nil {
+			return err
+		}
+
+		archive, err := apk.OpenGitArchive(cmd.Context(), archiveRepo)
+		if err != nil {
+			return err
+		}
+
+		versions, err := updater.Versions(cmd.Context(), game)
+		if err != nil {
+			return err
+		}
+		apk.SortVersions(versions) // Newest first
+
+		switch {
+		case archiveVersion != "":
+			r, err := apk.ParseVersionRange(archiveVersion)
+			if err != nil {
+				return err
+			}
+			versions = apk.FilterVersions(versions, r)
+		case archive.Empty(cmd.Context()):
+			updater.Log().Info("Archive is empty, archiving every version", "path", archiveRepo, "game", game.Name, "versions", len(versions))
+		case len(versions) > 0:
+			versions = versions[:1]
+		}
+		if len(versions) == 0 {
+			return fmt.Errorf("no versions of %s to archive", game.Name)
+		}
+
+		// Oldest first so the history reads forward
+		for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+			versions[i], versions[j] = versions[j], versions[i]
+		}
+		return updater.Archive(cmd.Context(), archive, game, versions, archiveKeep)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(archiveCmd)
+	archiveCmd.Flags().StringVar(&archiveRepo, "git", "", "Git repository to archive into, created if it doesn't exist")
+	archiveCmd.Flags().StringVarP(&archiveGame, "game", "g", "", "Game to archive (default is to prompt)")
+	archiveCmd.Flags().StringVarP(&archiveVersion, "version", "v", "", "Archive every version in this range (default is the newest, or everything for an empty repository)")
+	archiveCmd.Flags().BoolVar(&archiveKeep, "keep", false, "Keep the APK and extracted folders after committing them")
+	_ = archiveCmd.MarkFlagRequired("git")
+}
@@ -0,0 +1,134 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/amaanq/apk-updater/apk"
+	"github.com/spf13/cobra"
+)
+
+var backfillGame string
+var backfillFrom string
+var backfillTo string
+var backfillStateFile string
+var backfillConcurrency int
+var backfillInterval time.Duration
+var backfillKeep bool
+var backfillReport string
+
+// backfillCmd represents the backfill command
+var backfillCmd = &cobra.Command{
+	Use:   "backfill",
+	Short: "Download, extract and store every published version of a game",
+	Long: `Backfill fetches every version of a game (or those between --from and --to) oldest first and adds each to the store.
+
+Finished versions are recorded in a state file, so an interrupted backfill only fetches what's left when run again.
+A failing version doesn't stop the others, every failure is listed in the report at the end.`,
+	Annotations: map[string]string{needsStore: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		game, ok := apk.FindGame(backfillGame)
+		if !ok {
+			return fmt.Errorf("unknown game %q", backfillGame)
+		}
+
+		state, err := apk.LoadBackfillState(backfillStateFile)
+		if err != nil {
+			return err
+		}
+
+		versions, err := updater.Versions(cmd.Context(), game)
+		if err != nil {
+			return err
+		}
+		if r := backfillRange(); r != "" {
+			vr, err := apk.ParseVersionRange(r)
+			if err != nil {
+				return err
+			}
+			versions = apk.FilterVersions(versions, vr)
+		}
+		updater.Log().Info("Backfilling", "game", game.Name, "versions", len(versions), "store", updater.Store().Dir)
+
+		backfill := &apk.Backfill{
+			Updater:     updater,
+			Game:        game,
+			State:       state,
+			Concurrency: backfillConcurrency,
+			Interval:    backfillInterval,
+			Keep:        backfillKeep,
+		}
+		report, runErr := backfill.Run(cmd.Context(), versions)
+		if config.JSON {
+			_ = json.NewEncoder(os.Stdout).Encode(struct {
+				Event string `json:"event"`
+				*apk.BackfillReport
+			}{Event: "backfill_report", BackfillReport: report})
+		} else {
+			fmt.Println(report)
+		}
+
+		if backfillReport != "" {
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err = os.WriteFile(backfillReport, data, 0644); err != nil {
+				return err
+			}
+		}
+		if runErr != nil {
+			return runErr
+		}
+		if len(report.Failed) > 0 {
+			return fmt.Errorf("%d versions failed", len(report.Failed))
+		}
+		return nil
+	},
+}
+
+// Turns --from and --to into a version range, both ends included
+func backfillRange() string {
+	var parts []string
+	if backfillFrom != "" {
+		parts = append(parts, ">="+backfillFrom)
+	}
+	if backfillTo != "" {
+		parts = append(parts, "<="+backfillTo)
+	}
+	return strings.Join(parts, " ")
+}
+
+func init() {
+	rootCmd.AddCommand(backfillCmd)
+	backfillCmd.Flags().StringVarP(&backfillGame, "game", "g", "", "Game to backfill")
+	backfillCmd.Flags().StringVar(&backfillFrom, "from", "", "Oldest version to fetch (default is the first one published)")
+	backfillCmd.Flags().StringVar(&backfillTo, "to", "", "Newest version to fetch (default is the latest)")
+	backfillCmd.Flags().StringVar(&backfillStateFile, "state", apk.DefaultBackfillStateFile(), "File the completed versions are kept in")
+	backfillCmd.Flags().IntVarP(&backfillConcurrency, "concurrency", "c", apk.DefaultBackfillConcurrency, "How many versions to fetch at once")
+	backfillCmd.Flags().DurationVar(&backfillInterval, "interval", apk.DefaultBackfillInterval, "Minimum time between two downloads starting")
+	backfillCmd.Flags().BoolVar(&backfillKeep, "keep", false, "Keep the APK and extracted folders after storing them")
+	backfillCmd.Flags().StringVar(&backfillReport, "report", "", "Also write the final report as JSON to this file")
+	_ = backfillCmd.MarkFlagRequired("game")
+}
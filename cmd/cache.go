@@ -0,0 +1,49 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"github.com/amaanq/apk-updater/apk"
+	"github.com/spf13/cobra"
+)
+
+// cacheCmd represents the cache command
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the on-disk cache of scraped catalog pages",
+}
+
+// cacheClearCmd represents the cache clear command
+var cacheClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Delete every cached catalog page, other files in the cache folder are kept",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := config.Cache.Dir
+		if err := apk.ClearCache(dir); err != nil {
+			return err
+		}
+		updater.Log().Info("Cleared the cache", "path", dir)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheClearCmd)
+}
@@ -0,0 +1,285 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/amaanq/apk-updater/apk"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// The config file schema, see the README for an example. Every key can also be set through an environment
+// variable prefixed with APK_UPDATER_, http.user_agent becomes APK_UPDATER_HTTP_USER_AGENT, and flags win over both
+type Config struct {
+	OutputDir    string                `mapstructure:"output_dir"`
+	Source       string                `mapstructure:"source"`
+	Concurrency  int                   `mapstructure:"concurrency"`
+	PageInterval time.Duration         `mapstructure:"page_interval"`
+	Progress     string                `mapstructure:"progress"`
+	JSON         bool                  `mapstructure:"json"`
+	Log          apk.LogConfig         `mapstructure:"log"`
+	HTTP         apk.HTTPConfig        `mapstructure:"http"`
+	Cache        CacheConfig           `mapstructure:"cache"`
+	Store        StoreConfig           `mapstructure:"store"`
+	Games        map[string]GameConfig `mapstructure:"games"`
+	Hooks        apk.Hooks             `mapstructure:"hooks"`
+	Notify       NotifyConfig          `mapstructure:"notifications"`
+	Watch        WatchConfig           `mapstructure:"watch"`
+	Serve        ServeConfig           `mapstructure:"serve"`
+}
+
+type CacheConfig struct {
+	Disabled bool          `mapstructure:"disabled"`
+	TTL      time.Duration `mapstructure:"ttl"`
+	Dir      string        `mapstructure:"dir"`
+}
+
+type StoreConfig struct {
+	Dir string `mapstructure:"dir"` // empty means versions aren't stored
+}
+
+// A game to add, or settings overriding a built-in one, keyed by the game's name or slug
+type GameConfig struct {
+	Name         string            `mapstructure:"name"`          // display name of a new game, defaults to its key
+	Slugs        map[string]string `mapstructure:"slugs"`         // slug per source, e.g. uptodown: squad-busters
+	Package      string            `mapstructure:"package"`       // e.g. com.supercell.squad
+	Directories  []string          `mapstructure:"directories"`   // asset folders to decompress
+	SignerSHA256 string            `mapstructure:"signer_sha256"` // signing certificate fingerprint
+}
+
+type NotifyConfig struct {
+	Webhooks []string `mapstructure:"webhooks"` // [json|discord|slack=]URL
+}
+
+type WatchConfig struct {
+	Games        []string      `mapstructure:"games"`
+	Interval     time.Duration `mapstructure:"interval"`
+	Jitter       time.Duration `mapstructure:"jitter"`
+	State        string        `mapstructure:"state"`
+	FetchInitial bool          `mapstructure:"fetch_initial"`
+	MetricsAddr  string        `mapstructure:"metrics_addr"` // empty means no metrics endpoint
+}
+
+type ServeConfig struct {
+	Addr    string `mapstructure:"addr"`
+	Keep    bool   `mapstructure:"keep"`
+	Workers int    `mapstructure:"workers"`
+	Jobs    string `mapstructure:"jobs"` // empty means jobs.json in the store
+	UI      bool   `mapstructure:"ui"`
+}
+
+// The loaded config, set up before any command runs
+var config *Config
+
+// Every key with its default, which is also what makes viper look the key up in the environment
+func setConfigDefaults() {
+	viper.SetDefault("output_dir", ".")
+	viper.SetDefault("source", apk.Uptodown.Name())
+	viper.SetDefault("concurrency", apk.MaxConcurrentPages)
+	viper.SetDefault("page_interval", apk.PageInterval)
+	viper.SetDefault("progress", apk.ProgressAuto)
+	viper.SetDefault("json", false)
+	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.format", apk.LogText)
+	viper.SetDefault("log.file", "")
+	viper.SetDefault("http.retries", apk.DefaultHTTPRetries)
+	viper.SetDefault("http.timeout", time.Duration(0))
+	viper.SetDefault("http.user_agent", "")
+	viper.SetDefault("http.proxy", "")
+	viper.SetDefault("http.record", "")
+	viper.SetDefault("http.replay", "")
+	viper.SetDefault("cache.disabled", false)
+	viper.SetDefault("cache.ttl", apk.DefaultCacheTTL)
+	viper.SetDefault("cache.dir", apk.DefaultCacheDir())
+	viper.SetDefault("store.dir", "")
+	viper.SetDefault("hooks.on_download", []string{})
+	viper.SetDefault("hooks.on_decompile", []string{})
+	viper.SetDefault("hooks.on_decompress", []string{})
+	viper.SetDefault("hooks.on_error", []string{})
+	viper.SetDefault("hooks.timeout", apk.DefaultHookTimeout)
+	viper.SetDefault("notifications.webhooks", []string{})
+	viper.SetDefault("watch.games", []string{})
+	viper.SetDefault("watch.interval", time.Hour)
+	viper.SetDefault("watch.jitter", 5*time.Minute)
+	viper.SetDefault("watch.state", apk.DefaultWatchStateFile())
+	viper.SetDefault("watch.fetch_initial", false)
+	viper.SetDefault("watch.metrics_addr", "")
+	viper.SetDefault("serve.addr", "localhost:8080")
+	viper.SetDefault("serve.keep", false)
+	viper.SetDefault("serve.workers", apk.DefaultJobWorkers)
+	viper.SetDefault("serve.jobs", "")
+	viper.SetDefault("serve.ui", true)
+}
+
+// Makes a flag override a config key
+func bindFlag(key string, flags *pflag.FlagSet, name string) {
+	if err := viper.BindPFlag(key, flags.Lookup(name)); err != nil {
+		panic(err)
+	}
+}
+
+func loadConfig() (*Config, error) {
+	cfg := &Config{}
+	if err := viper.Unmarshal(cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if cfg.Concurrency < 1 {
+		return nil, fmt.Errorf("invalid config: concurrency must be at least 1, got %d", cfg.Concurrency)
+	}
+	if cfg.Serve.Workers < 1 {
+		return nil, fmt.Errorf("invalid config: serve.workers must be at least 1, got %d", cfg.Serve.Workers)
+	}
+	if cfg.HTTP.Retries < 0 {
+		return nil, fmt.Errorf("invalid config: http.retries can't be negative, got %d", cfg.HTTP.Retries)
+	}
+	for _, path := range []*string{&cfg.OutputDir, &cfg.Log.File, &cfg.HTTP.Record, &cfg.HTTP.Replay, &cfg.Cache.Dir, &cfg.Store.Dir, &cfg.Watch.State, &cfg.Serve.Jobs} {
+		expanded, err := expandHome(*path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: %w", err)
+		}
+		*path = expanded
+	}
+	return cfg, nil
+}
+
+// Turns a leading ~ into the home folder, the shell doesn't do it for the config file or --flag=~/...
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, `~`+string(filepath.Separator)) {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("can't expand %s: %w", path, err)
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+// Merges the configured games into the built-in ones, a set field overrides the built-in value
+func (c *Config) applyGames() {
+	keys := make([]string, 0, len(c.Games))
+	for key := range c.Games {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // Stable order for new games in prompts
+
+	for _, key := range keys {
+		settings := c.Games[key]
+		game := apk.GameLink{Name: key}
+		existing, ok := apk.FindGame(key)
+		if !ok && settings.Name != "" { // e.g. key squad with name Squad Busters
+			existing, ok = apk.FindGame(settings.Name)
+		}
+		if ok {
+			game = *existing
+		}
+		if settings.Name != "" {
+			game.Name = settings.Name
+		}
+		if settings.Slugs != nil {
+			game.Slugs = settings.Slugs
+			game.URL = "" // derived from the slug from now on
+		}
+		if settings.Package != "" {
+			game.Package = settings.Package
+		}
+		if settings.Directories != nil {
+			game.ValidDirectories = settings.Directories
+		}
+		if settings.SignerSHA256 != "" {
+			game.SignerSHA256 = settings.SignerSHA256
+		}
+		if ok {
+			*existing = game // Also renames it when a new name was given
+		} else {
+			apk.RegisterGame(game)
+		}
+	}
+}
+
+// Closes the log file once the command is done, see Execute
+var logFile io.Closer = io.NopCloser(nil)
+
+// Builds the updater every command works through from the config
+func (c *Config) updater() (*apk.Updater, error) {
+	c.applyGames()
+	source, err := apk.FindSource(c.Source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	client, err := apk.NewHTTPClient(c.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	// In JSON mode stdout only carries events, logs move to stderr
+	console := os.Stdout
+	var progress apk.Progress
+	var events apk.EventSink
+	if c.JSON {
+		stream := apk.NewJSONProgress(os.Stdout)
+		console, progress, events = os.Stderr, stream, stream
+	} else if progress, err = apk.NewProgress(c.Progress, os.Stdout); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	logger, closer, err := apk.NewConfiguredLogger(c.Log, console)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	logFile = closer
+
+	hooks := c.Hooks
+	opts := []apk.Option{
+		apk.WithHTTPClient(client),
+		apk.WithLogger(logger),
+		apk.WithEvents(events),
+		apk.WithOutputRoot(c.OutputDir),
+		apk.WithSource(source),
+		apk.WithConcurrency(c.Concurrency),
+		apk.WithPageInterval(c.PageInterval),
+		apk.WithProgress(progress),
+		apk.WithHooks(&hooks),
+		apk.WithMetrics(apk.NewMetrics()),
+	}
+	// Cached pages would never reach a recording, and replays shouldn't be answered from the cache either
+	if !c.Cache.Disabled && c.HTTP.Record == "" && c.HTTP.Replay == "" {
+		opts = append(opts, apk.WithCache(c.Cache.Dir, c.Cache.TTL))
+	}
+	if c.Store.Dir != "" {
+		store, err := apk.OpenStore(c.Store.Dir)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, apk.WithStore(store))
+	}
+	return apk.New(opts...), nil
+}
+
+func init() {
+	viper.SetEnvPrefix("APK_UPDATER")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	setConfigDefaults()
+}
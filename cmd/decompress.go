@@ -19,11 +19,11 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"sort"
-	"strconv"
 	"strings"
 
 	"github.com/amaanq/apk-updater/apk"
@@ -34,6 +34,7 @@ import (
 var inputDecompressFP string
 var inputAssetsFP string
 var outputDecompressFP string
+var decompressVersion string
 
 // decompressCmd represents the decompress command
 var decompressCmd = &cobra.Command{
@@ -53,76 +54,7 @@ var decompressCmd = &cobra.Command{
 
 		switch {
 		case inputDecompressFP == "" && inputAssetsFP == "": // Default case
-			game, err := selectGame("Which game do you want to download and decompress") // Have user pick a game
-			if err != nil {
-				return err
-			}
-
-			apk.Log.Info(game.URL)
-
-			versions, err := apk.GetAllVersions(game.URL) // Get game versions
-			if err != nil {
-				return err
-			}
-
-			sort.SliceStable(versions, func(i, j int) bool { // Sort by order
-				n_i_nums := strings.Split(versions[i].Version, ".")
-				n_j_nums := strings.Split(versions[j].Version, ".")
-				n_i, _ := strconv.Atoi(n_i_nums[0])
-				n_j, _ := strconv.Atoi(n_j_nums[0])
-				if n_i == n_j && len(n_i_nums) >= 2 && len(n_j_nums) >= 2 { // If both versions are of the same major version, but not the same minor version
-					n_i, _ = strconv.Atoi(n_i_nums[1])
-					n_j, _ = strconv.Atoi(n_j_nums[1])
-					if n_i == n_j && len(n_i_nums) >= 3 && len(n_j_nums) >= 3 { // If both versions are of the same major version, minor version, but not build version
-						n_i, _ = strconv.Atoi(n_i_nums[2])
-						n_j, _ = strconv.Atoi(n_j_nums[2])
-					}
-				}
-				return n_i > n_j
-			})
-
-			version, err := selectVersion(versions) // Have user pick a version
-			if err != nil {
-				return err
-			}
-
-			_bool := askToOnlyStoreAssets()
-
-			_sc := askToDecompressDotSCFiles()
-			if _sc {
-				game.ValidDirectories = append(game.ValidDirectories, "sc")
-			} else {
-				apk.Log.Info("Not decompressing .sc files")
-			}
-
-			apk.Log.Infof("Downloading %s APK Version %s (Released on %s)\n", game.Name, version.Version, version.Date)
-			fp, err := apk.WgetAPK(game, version.DownloadURL, version.Version, "") // Download the apk to name-version.apk, return stored file path .apk
-			if err != nil {
-				return err
-			}
-
-			err = apk.DecompileAPK(fp) // Decompile this apk from file path above (same path as apk without .apk)
-			if err != nil {
-				return err
-			}
-
-			if outputDecompressFP == "" {
-				outputDecompressFP = defaultAssetOutputFolder(game, version)
-			}
-
-			if strings.TrimSuffix(fp, ".apk") == outputDecompressFP { // in case they're matching directories
-				outputDecompressFP += "/decompressed"
-			}
-			assetsFP, err := apk.WalkAndDecompressAssets(game.ValidDirectories, strings.TrimSuffix(fp, ".apk"), outputDecompressFP)
-			if err != nil {
-				return err
-			}
-
-			if _bool {
-				_ = apk.CleanUp(assetsFP, fp)
-				assetsFP = "decompressed"
-			}
-			apk.Log.Infof("Done! Decompressed assets stored in ./%s\n", assetsFP)
+			return downloadAndDecompress(cmd.Context())
 		case inputDecompressFP != "":
 			game, err := selectGame("What game is this (needed for knowing what folders to parse..)") // Have user pick a game
 			if err != nil {
@@ -148,22 +80,18 @@ var decompressCmd = &cobra.Command{
 			if !strings.HasSuffix(inputDecompressFP, ".apk") {
 				return errors.New("invalid file path, must end in .apk")
 			}
-			err = apk.DecompileAPK(inputDecompressFP)
-			if err != nil {
-				return err
-			}
-			inputAssetsFP = strings.TrimSuffix(inputDecompressFP, ".apk")
-
 			if outputDecompressFP == "" {
 				outputDecompressFP = strings.TrimSuffix(inputDecompressFP, ".apk") + "-decompressed"
 			}
-			assetsFP, err := apk.WalkAndDecompressAssets(game.ValidDirectories, inputAssetsFP, outputDecompressFP)
+			release, err := updater.DecompressAPK(cmd.Context(), game, inputDecompressFP, outputDecompressFP)
 			if err != nil {
 				return err
 			}
-			apk.Log.Infof("Assets stored in %s\n", assetsFP)
+			updater.Log().Info("Assets stored", "path", release.AssetsPath)
 			if _bool {
-				_ = apk.CleanUp(assetsFP, inputDecompressFP)
+				if err = release.RemoveIntermediates(); err != nil {
+					return err
+				}
 			}
 		case inputAssetsFP != "":
 			game, err := selectGame("What game is this (needed for knowing what folders to parse..)") // Have user pick a game
@@ -189,19 +117,69 @@ var decompressCmd = &cobra.Command{
 			if outputDecompressFP == "" {
 				outputDecompressFP = inputAssetsFP + "-decompressed"
 			}
-			assetsFP, err := apk.WalkAndDecompressAssets(game.ValidDirectories, inputAssetsFP, outputDecompressFP)
+			release, err := updater.DecompressDecompiled(cmd.Context(), game, inputAssetsFP, outputDecompressFP)
 			if err != nil {
 				return err
 			}
-			apk.Log.Infof("Assets stored in %s\n", assetsFP)
+			updater.Log().Info("Assets stored", "path", release.AssetsPath)
 			if _bool {
-				_ = apk.CleanUp(assetsFP, inputAssetsFP)
+				if err = release.RemoveIntermediates(); err != nil {
+					return err
+				}
 			}
 		}
 		return nil
 	},
 }
 
+// Default mode of decompress, prompts for a game and version then downloads, decompiles and decompresses it
+func downloadAndDecompress(ctx context.Context) error {
+	game, err := selectGame("Which game do you want to download and decompress") // Have user pick a game
+	if err != nil {
+		return err
+	}
+
+	updater.Log().Info(updater.Source().AppURL(game))
+
+	versions, err := updater.Versions(ctx, game) // Get game versions
+	if err != nil {
+		return err
+	}
+
+	apk.SortVersions(versions) // Newest first
+
+	version, err := chooseVersion(versions, decompressVersion) // Have user pick a version unless one was given
+	if err != nil {
+		return err
+	}
+
+	_bool := askToOnlyStoreAssets()
+
+	_sc := askToDecompressDotSCFiles()
+	if _sc {
+		game.ValidDirectories = append(game.ValidDirectories, "sc")
+	} else {
+		updater.Log().Info("Not decompressing .sc files")
+	}
+
+	var opts []apk.FetchOption
+	if outputDecompressFP != "" {
+		opts = append(opts, apk.WithAssetsDir(outputDecompressFP))
+	}
+	release, err := updater.Fetch(ctx, game, *version, opts...)
+	if err != nil {
+		return err
+	}
+
+	if _bool {
+		if err = release.RemoveIntermediates(); err != nil {
+			return err
+		}
+	}
+	updater.Log().Info("Done! Decompressed assets stored", "path", release.AssetsPath)
+	return nil
+}
+
 func selectGame(_prompt string) (*apk.GameLink, error) {
 	templates := &promptui.SelectTemplates{
 		Label:    "		{{ . }}?",
@@ -217,6 +195,7 @@ func selectGame(_prompt string) (*apk.GameLink, error) {
 		Items:     apk.AllGameLinks,
 		Templates: templates,
 		Size:      10,
+		Stdout:    promptOutput(),
 	}
 	index, _, err := prompt.Run()
 	if err != nil {
@@ -241,6 +220,7 @@ func selectVersion(versions []apk.VersionData) (*apk.VersionData, error) {
 		Items:     versions,
 		Templates: templates,
 		Size:      10,
+		Stdout:    promptOutput(),
 	}
 	index, _, err := prompt.Run()
 	if err != nil {
@@ -249,10 +229,29 @@ func selectVersion(versions []apk.VersionData) (*apk.VersionData, error) {
 	return &versions[index], nil
 }
 
+// Picks the newest version inside the given range, or prompts the user if no range was given
+func chooseVersion(versions []apk.VersionData, constraint string) (*apk.VersionData, error) {
+	if constraint == "" {
+		return selectVersion(versions)
+	}
+
+	r, err := apk.ParseVersionRange(constraint)
+	if err != nil {
+		return nil, err
+	}
+	matched := apk.FilterVersions(versions, r)
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no version matches %s", r)
+	}
+	apk.SortVersions(matched)
+	return &matched[0], nil
+}
+
 func askToOnlyStoreAssets() bool {
 	prompt := promptui.Prompt{
 		Label:     "Do you want to clean up all files but the decompress ones?",
 		IsConfirm: true,
+		Stdout:    promptOutput(),
 	}
 	result, err := prompt.Run()
 	if err != nil {
@@ -265,6 +264,7 @@ func askToDecompressDotSCFiles() bool {
 	prompt := promptui.Prompt{
 		Label:     "Do you want to decompress .sc files NOTE: This uses a LOT of memory, >=8GB of RAM is recommended?",
 		IsConfirm: true,
+		Stdout:    promptOutput(),
 	}
 	result, err := prompt.Run()
 	if err != nil {
@@ -273,13 +273,32 @@ func askToDecompressDotSCFiles() bool {
 	return result == "y" || result == "Y"
 }
 
-func defaultAssetOutputFolder(game *apk.GameLink, version *apk.VersionData) string {
-	return fmt.Sprintf("%s-%s", strings.ToLower(strings.ReplaceAll(game.Name, " ", "")), version.Version)
+// Runs the on_error hooks before handing err back, unless the user cancelled
+func hookError(ctx context.Context, hc apk.HookContext, err error) error {
+	if ctx.Err() == nil {
+		hc.Err = err
+		_ = updater.RunHooks(ctx, apk.OnError, hc)
+	}
+	return err
+}
+
+// Prompts draw on stderr in JSON mode so stdout only carries events
+func promptOutput() io.WriteCloser {
+	if config != nil && config.JSON {
+		return os.Stderr
+	}
+	return nil
+}
+
+// Tells JSON consumers the download link of version is known
+func emitResolved(game *apk.GameLink, version *apk.VersionData, url string) {
+	updater.Emit(apk.ResolvedEvent(game, *version, url))
 }
 
 func init() {
 	rootCmd.AddCommand(decompressCmd)
 	decompressCmd.Flags().StringVarP(&inputDecompressFP, "file", "f", "", "Point to the APK to decompress")
 	decompressCmd.Flags().StringVarP(&inputAssetsFP, "directory", "d", "", "Point to the assets folder to decompress")
-	decompressCmd.Flags().StringVarP(&outputDecompressFP, "output", "o", "", "Set the output folder for the decompressed APK (default is clash-major.minor.build)")
+	decompressCmd.Flags().StringVarP(&decompressVersion, "version", "v", "", "The version to download, either exact (15.83.24) or a range (\">=15.0 <16\"), newest match wins (default is to prompt)")
+	decompressCmd.Flags().StringVarP(&outputDecompressFP, "output", "o", "", "Set the output folder for the decompressed assets (default is slug-version-decompressed in the output folder)")
 }
@@ -19,9 +19,8 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
-	"sort"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/amaanq/apk-updater/apk"
 	"github.com/spf13/cobra"
@@ -34,10 +33,10 @@ var outputDownloadFP string
 var downloadCmd = &cobra.Command{
 	Use:   "download",
 	Short: "Download the Clash of Clans apk",
-	Long:  `This will eventually support multiple versions, but for now the latest one is the only one available.`,
-	RunE: func(cmd *cobra.Command, args []string) error {
+	Long:  `Download an APK of the chosen game. Pick the version from the prompt or pass --version with an exact version or a range like ">=15.0 <16".`,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		if outputDownloadFP != "" && !strings.HasSuffix(outputDownloadFP, ".apk") {
-			apk.Log.Warnf("The given output file path (%s) does not end in .apk, this can cause issues down the road...", outputDownloadFP)
+			updater.Log().Warn("The given output file path does not end in .apk, this can cause issues down the road...", "path", outputDownloadFP)
 		}
 
 		game, err := selectGame("Which game do you want to download and decompress") // Have user pick a game
@@ -45,38 +44,41 @@ var downloadCmd = &cobra.Command{
 			return err
 		}
 
-		versions, err := apk.GetAllVersions(game.URL) // Get game versions
+		versions, err := updater.Versions(cmd.Context(), game) // Get game versions
 		if err != nil {
 			return err
 		}
 
-		sort.SliceStable(versions, func(i, j int) bool { // Sort by order
-			n_i_nums := strings.Split(versions[i].Version, ".")
-			n_j_nums := strings.Split(versions[j].Version, ".")
-			n_i, _ := strconv.Atoi(n_i_nums[0])
-			n_j, _ := strconv.Atoi(n_j_nums[0])
-			if n_i == n_j && len(n_i_nums) >= 2 && len(n_j_nums) >= 2 { // If both versions are of the same major version, but not the same minor version
-				n_i, _ = strconv.Atoi(n_i_nums[1])
-				n_j, _ = strconv.Atoi(n_j_nums[1])
-				if n_i == n_j && len(n_i_nums) >= 3 && len(n_j_nums) >= 3 { // If both versions are of the same major version, minor version, but not build version
-					n_i, _ = strconv.Atoi(n_i_nums[2])
-					n_j, _ = strconv.Atoi(n_j_nums[2])
-				}
-			}
-			return n_i > n_j
-		})
-
-		version, err := selectVersion(versions) // Have user pick a version
+		apk.SortVersions(versions) // Newest first
+
+		version, err := chooseVersion(versions, desiredVersion) // Have user pick a version unless one was given
 		if err != nil {
 			return err
 		}
 
-		apk.Log.Infof("Downloading %s APK Version %s (Released on %s)\n", game.Name, version.Version, version.Date)
-		_, err = apk.WgetAPK(game, version.DownloadURL, version.Version, outputDownloadFP) // Download the apk
+		hc := apk.HookContext{Game: game.Name, Version: version.Version.String()}
+		var summary apk.Summary
+		defer func(start time.Time) {
+			updater.Emit(apk.SummaryEvent(game, version.Version, start, summary, err))
+		}(time.Now())
+
+		downloadURL, err := updater.Resolve(cmd.Context(), version) // Only now scrape the download link
 		if err != nil {
-			return err
+			return hookError(cmd.Context(), hc, err)
+		}
+		emitResolved(game, version, downloadURL)
+
+		updater.Log().Info("Downloading APK", "game", game.Name, "version", version.Version, "date", version.Date)
+		hc.APKPath, err = updater.WgetAPK(cmd.Context(), game, downloadURL, version.Version.String(), outputDownloadFP) // Download the apk
+		if err != nil {
+			return hookError(cmd.Context(), hc, err)
+		}
+		summary.APKPath = hc.APKPath
+		if err = updater.VerifySigner(cmd.Context(), game, hc.APKPath); err != nil {
+			return hookError(cmd.Context(), hc, err)
 		}
-		apk.Log.Infof("Downloaded %s-%s.apk Successfully!", strings.ToLower(strings.ReplaceAll(game.Name, " ", "")), version.Version)
+		_ = updater.RunHooks(cmd.Context(), apk.OnDownload, hc)
+		updater.Log().Info("Downloaded successfully!", "game", game.Name, "version", version.Version)
 		return nil
 	},
 }
@@ -84,6 +86,6 @@ var downloadCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(downloadCmd)
 
-	downloadCmd.Flags().StringVarP(&desiredVersion, "version", "v", "", "The desired version of the APK to download (default is newest, older versions unimplemented as of now)")
+	downloadCmd.Flags().StringVarP(&desiredVersion, "version", "v", "", "The version to download, either exact (15.83.24) or a range (\">=15.0 <16\"), newest match wins (default is to prompt)")
 	downloadCmd.Flags().StringVarP(&outputDownloadFP, "output", "o", "", "Set the output folder for the decompressed APK (default is clash-major.minor.build")
 }
@@ -19,15 +19,25 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/amaanq/apk-updater/apk"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var cfgFile string
 
+// Commands annotated with this always get a store, the default one unless --store is given
+const needsStore = "needs-store"
+
+// The updater every command works through, set up before any command runs
+var updater *apk.Updater
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "apk-updater",
@@ -38,12 +48,30 @@ To get started, run one of the following commands below.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		if cfg.Store.Dir == "" && cmd.Annotations[needsStore] != "" {
+			cfg.Store.Dir = apk.DefaultStoreDir()
+		}
+		if updater, err = cfg.updater(); err != nil {
+			return err
+		}
+		config = cfg
+		return nil
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// Ctrl-C and SIGTERM cancel the command's context so downloads and apktool stop cleanly.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	logFile.Close()
 	if err != nil {
 		os.Exit(1)
 	}
@@ -57,6 +85,39 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.apk-updater.yaml)")
+	flags := rootCmd.PersistentFlags()
+	flags.String("output-dir", ".", "Folder APKs and assets are written to unless a path is given")
+	flags.String("source", apk.Uptodown.Name(), "Where versions are scraped from")
+	flags.Int("page-concurrency", apk.MaxConcurrentPages, "How many versions pages are fetched at once")
+	flags.String("progress", apk.ProgressAuto, "How progress is shown: auto, tty, plain, json or none")
+	flags.Bool("json", false, "Write pipeline events as newline delimited JSON on stdout, logs go to stderr")
+	flags.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	flags.String("log-format", apk.LogText, "How log lines are written: text or json")
+	flags.String("log-file", "", "Also append log lines to this file")
+	flags.Int("retries", apk.DefaultHTTPRetries, "How many times a failed request is retried")
+	flags.Duration("timeout", 0, "How long connecting and waiting for response headers may take, downloads aren't cut off. 0 means none")
+	flags.String("proxy", "", "Proxy every request goes through (default is $HTTPS_PROXY)")
+	flags.String("record", "", "Save every HTTP exchange to this folder, e.g. to attach a failing run to a bug report")
+	flags.String("replay", "", "Answer HTTP requests from a folder made with --record instead of the network")
+	flags.Bool("no-cache", false, "Always fetch catalog pages from the mirror instead of the on-disk cache")
+	flags.Duration("cache-ttl", apk.DefaultCacheTTL, "How long cached catalog pages are used before being revalidated")
+	flags.String("store", "", "Also add decompressed versions to the content addressed store in this folder")
+	bindFlag("output_dir", flags, "output-dir")
+	bindFlag("source", flags, "source")
+	bindFlag("concurrency", flags, "page-concurrency")
+	bindFlag("progress", flags, "progress")
+	bindFlag("json", flags, "json")
+	bindFlag("log.level", flags, "log-level")
+	bindFlag("log.format", flags, "log-format")
+	bindFlag("log.file", flags, "log-file")
+	bindFlag("http.retries", flags, "retries")
+	bindFlag("http.timeout", flags, "timeout")
+	bindFlag("http.proxy", flags, "proxy")
+	bindFlag("http.record", flags, "record")
+	bindFlag("http.replay", flags, "replay")
+	bindFlag("cache.disabled", flags, "no-cache")
+	bindFlag("cache.ttl", flags, "cache-ttl")
+	bindFlag("store.dir", flags, "store")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -79,10 +140,13 @@ func initConfig() {
 		viper.SetConfigName(".apk-updater")
 	}
 
-	viper.AutomaticEnv() // read in environment variables that match
+	viper.AutomaticEnv() // read in environment variables that match, see Config
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
+	err := viper.ReadInConfig()
+	if err == nil {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	} else if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+		cobra.CheckErr(fmt.Errorf("reading config: %w", err))
 	}
 }
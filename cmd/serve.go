@@ -0,0 +1,112 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/amaanq/apk-updater/apk"
+	"github.com/spf13/cobra"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:         "serve",
+	Annotations: map[string]string{needsStore: "true"},
+	Short:       "Serve the store's games, versions and assets over HTTP",
+	Long: `Serve exposes the store (--store, or ` + apk.DefaultStoreDir() + ` when not given) as a web UI on / for browsing
+CSV tables and comparing versions, and as a JSON API:
+
+  GET  /api/games                                    every game, with how many versions are stored
+  GET  /api/games/{game}/versions                    stored versions, newest first
+  POST /api/games/{game}/fetch?version=1.2.3         queue a fetch of a version into the store, the newest without version
+  GET  /api/games/{game}/versions/{version}/files    the version's file listing
+  GET  /api/games/{game}/versions/{version}/files/*  a decompressed asset
+  GET  /api/games/{game}/versions/{version}/csv/*    a CSV asset as JSON, typed by its type row
+  GET  /api/games/{game}/diff?from=1.2.3&to=1.3.0    files added, removed and modified between two versions
+  GET  /api/jobs                                     every fetch job, newest first
+  GET  /api/jobs/{id}                                one job with its status, logs and result
+  GET  /metrics                                      Prometheus metrics
+
+Fetches run as jobs on --workers workers, a fetch of a version that is already queued or running joins that job.
+Jobs are kept in --jobs, so queued ones and ones cut short by Ctrl-C or SIGTERM are picked up on the next start.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		jobsFile := config.Serve.Jobs
+		if jobsFile == "" {
+			jobsFile = apk.DefaultJobsFile(updater.Store())
+		}
+		jobs, err := apk.OpenJobQueue(updater, jobsFile)
+		if err != nil {
+			return err
+		}
+		jobs.Workers, jobs.Keep = config.Serve.Workers, config.Serve.Keep
+		server, err := apk.NewServer(updater, jobs)
+		if err != nil {
+			return err
+		}
+		server.UI = config.Serve.UI
+
+		listener, err := net.Listen("tcp", config.Serve.Addr)
+		if err != nil {
+			return fmt.Errorf("serving: %w", err)
+		}
+		httpServer := &http.Server{Handler: server, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = httpServer.Shutdown(shutdownCtx)
+		}()
+
+		workersDone := make(chan struct{})
+		go func() {
+			jobs.Run(ctx)
+			close(workersDone)
+		}()
+
+		updater.Log().Info("Serving", "url", "http://"+listener.Addr().String(), "store", updater.Store().Dir, "workers", jobs.Workers)
+		err = httpServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		<-workersDone
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	flags := serveCmd.Flags()
+	flags.String("addr", "localhost:8080", "Address to listen on")
+	flags.Bool("keep", false, "Keep the APK and decompiled files of fetched versions instead of only the stored assets")
+	flags.IntP("workers", "w", apk.DefaultJobWorkers, "How many fetch jobs run at once")
+	flags.String("jobs", "", "File jobs are kept in (default is jobs.json in the store)")
+	flags.Bool("ui", true, "Serve the web UI on /")
+	bindFlag("serve.addr", flags, "addr")
+	bindFlag("serve.keep", flags, "keep")
+	bindFlag("serve.workers", flags, "workers")
+	bindFlag("serve.jobs", flags, "jobs")
+	bindFlag("serve.ui", flags, "ui")
+}
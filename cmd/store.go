@@ -0,0 +1,132 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/amaanq/apk-updater/apk"
+	"github.com/spf13/cobra"
+)
+
+var storeCopy bool
+
+// storeCmd represents the store command
+var storeCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Manage the content addressed store of decompressed assets",
+	Long: `The store keeps every unique asset file once, no matter how many versions share it, plus a manifest per version.
+Versions are added by passing --store to decompress, watch or archive. It lives in --store, or ` + apk.DefaultStoreDir() + ` when not given.`,
+}
+
+// storeListCmd represents the store list command
+var storeListCmd = &cobra.Command{
+	Use:         "list [game]",
+	Annotations: map[string]string{needsStore: "true"},
+	Short:       "List the stored games, or the stored versions of a game",
+	Args:        cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store := updater.Store()
+		if len(args) == 0 {
+			games, err := store.Games()
+			if err != nil {
+				return err
+			}
+			for _, game := range games {
+				fmt.Println(game)
+			}
+			return nil
+		}
+
+		versions, err := store.Versions(storeSlug(args[0]))
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			fmt.Println(v)
+		}
+		return nil
+	},
+}
+
+// storeCheckoutCmd represents the store checkout command
+var storeCheckoutCmd = &cobra.Command{
+	Use:         "checkout <game> <version> <dir>",
+	Annotations: map[string]string{needsStore: "true"},
+	Short:       "Recreate the assets of a stored version in a folder",
+	Args:        cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store := updater.Store()
+		m, err := store.Manifest(storeSlug(args[0]), args[1])
+		if err != nil {
+			return err
+		}
+		if err = store.Materialize(m, args[2], storeCopy); err != nil {
+			return err
+		}
+		updater.Log().Info("Checked out", "game", m.Game, "version", m.Version, "files", len(m.Files), "path", args[2])
+		return nil
+	},
+}
+
+// storeRmCmd represents the store rm command
+var storeRmCmd = &cobra.Command{
+	Use:         "rm <game> <version>",
+	Annotations: map[string]string{needsStore: "true"},
+	Short:       "Remove a version from the store, run gc afterwards to free its files",
+	Args:        cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store := updater.Store()
+		return store.Delete(storeSlug(args[0]), args[1])
+	},
+}
+
+// storeGCCmd represents the store gc command
+var storeGCCmd = &cobra.Command{
+	Use:         "gc",
+	Annotations: map[string]string{needsStore: "true"},
+	Short:       "Delete files no stored version uses anymore",
+	Long: `Delete files no stored version uses anymore.
+
+Don't run it while serve, backfill or another command is adding versions to the same store. Files written in the last
+hour are always kept so a version being added elsewhere is less likely to lose them.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store := updater.Store()
+		removed, freed, err := store.GC()
+		if err != nil {
+			return err
+		}
+		updater.Log().Info("Removed unreferenced files", "files", removed, "freed_mb", float64(freed)/1024/1024)
+		return nil
+	},
+}
+
+// Accepts a game's name or its slug
+func storeSlug(name string) string {
+	if game, ok := apk.FindGame(name); ok {
+		return game.Slug()
+	}
+	return name
+}
+
+func init() {
+	rootCmd.AddCommand(storeCmd)
+	storeCmd.AddCommand(storeListCmd, storeCheckoutCmd, storeRmCmd, storeGCCmd)
+	storeCheckoutCmd.Flags().BoolVar(&storeCopy, "copy", false, "Copy files instead of hardlinking them to the store")
+}
@@ -0,0 +1,153 @@
+/*
+The GPLv3 License (GPLv3)
+
+Copyright (c) 2023 Amaan Qureshi <amaanq12@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/amaanq/apk-updater/apk"
+	"github.com/spf13/cobra"
+)
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Poll games for new versions and fetch them as they come out",
+	Long: `Watch checks every game on an interval and, when a new version shows up, downloads, decompiles and decompresses it.
+
+The last version seen per game is kept in a state file, so restarting the watcher doesn't fetch everything again.
+Games seen for the first time are only recorded unless --fetch-initial is given. Stop it with Ctrl-C or SIGTERM.
+With --metrics-addr, Prometheus metrics about checks, downloads and decompression are served on /metrics.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		games, err := gamesByName(config.Watch.Games)
+		if err != nil {
+			return err
+		}
+
+		state, err := apk.LoadWatchState(config.Watch.State)
+		if err != nil {
+			return err
+		}
+
+		// Same proxy, timeout, retries and user agent as every other request, but webhook posts (and their secret URLs)
+		// are never recorded or replayed
+		httpConfig := config.HTTP
+		httpConfig.Record, httpConfig.Replay = "", ""
+		client, err := apk.NewHTTPClient(httpConfig)
+		if err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+		notifiers := make(apk.MultiNotifier, 0)
+		for _, spec := range config.Notify.Webhooks {
+			webhook, err := apk.ParseWebhook(spec, client)
+			if err != nil {
+				return err
+			}
+			notifiers = append(notifiers, webhook)
+		}
+
+		watcher := &apk.Watcher{
+			Updater:      updater,
+			Games:        games,
+			State:        state,
+			Interval:     config.Watch.Interval,
+			Jitter:       config.Watch.Jitter,
+			FetchInitial: config.Watch.FetchInitial,
+		}
+		if len(notifiers) > 0 {
+			watcher.Notifier = notifiers
+		}
+		if config.Watch.MetricsAddr != "" {
+			stop, err := serveMetrics(config.Watch.MetricsAddr)
+			if err != nil {
+				return err
+			}
+			defer stop()
+		}
+		updater.Log().Info("Watching", "games", len(games), "interval", config.Watch.Interval, "state", config.Watch.State)
+		return watcher.Run(cmd.Context())
+	},
+}
+
+// Serves the updater's metrics on addr until stop is called
+func serveMetrics(addr string) (stop func(), err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("serving metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", updater.Metrics())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			updater.Log().Error("Serving metrics failed", "addr", addr, "err", err)
+		}
+	}()
+	updater.Log().Info("Serving metrics", "url", "http://"+listener.Addr().String()+"/metrics")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}, nil
+}
+
+// Looks up games by name, no names means every game
+func gamesByName(names []string) ([]*apk.GameLink, error) {
+	games := make([]*apk.GameLink, 0)
+	if len(names) == 0 {
+		for i := range apk.AllGameLinks {
+			games = append(games, &apk.AllGameLinks[i])
+		}
+		return games, nil
+	}
+
+	for _, name := range names {
+		game, ok := apk.FindGame(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown game %q", name)
+		}
+		games = append(games, game)
+	}
+	return games, nil
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+	flags := watchCmd.Flags()
+	flags.StringSliceP("game", "g", nil, "Game to watch, can be repeated (default is every game)")
+	flags.DurationP("interval", "i", time.Hour, "How long to wait between checks")
+	flags.Duration("jitter", 5*time.Minute, "Randomly shift every wait by up to this much")
+	flags.String("state", apk.DefaultWatchStateFile(), "File the last seen version of each game is kept in")
+	flags.StringArray("webhook", nil, "Webhook to notify about new versions as [json|discord|slack=]URL, can be repeated")
+	flags.Bool("fetch-initial", false, "Also fetch games the watcher hasn't seen before")
+	flags.String("metrics-addr", "", "Serve Prometheus metrics on this address, e.g. :9090 (default is off)")
+	bindFlag("watch.games", flags, "game")
+	bindFlag("watch.interval", flags, "interval")
+	bindFlag("watch.jitter", flags, "jitter")
+	bindFlag("watch.state", flags, "state")
+	bindFlag("notifications.webhooks", flags, "webhook")
+	bindFlag("watch.fetch_initial", flags, "fetch-initial")
+	bindFlag("watch.metrics_addr", flags, "metrics-addr")
+}